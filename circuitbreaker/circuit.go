@@ -1,27 +1,36 @@
 package circuitbreaker
 
 import (
+  "context"
   "errors"
+  "fmt"
+  "math"
+  "math/rand"
+  "runtime/debug"
+  "sync"
   "sync/atomic"
   "time"
 
+  "github.com/ocampeau/gutils/circuitbreaker/clock"
   "github.com/ocampeau/gutils/circuitbreaker/strategy"
 )
 
 type OnStateChangeHook = func()
+type OnFallbackHook = func(err error)
 type Op = func() error
+type OpContext = func(ctx context.Context) error
+type FailurePredicate = func(err error) bool
+type Fallback = func(err error) error
 type Options func(breaker *CircuitBreaker)
 
 var (
   ErrCircuitOpen     = errors.New("http circuit breaker is open")
   ErrCircuitInternal = errors.New("internal error with circuit breaker")
+  ErrSlowCall        = errors.New("call exceeded the slow call duration threshold")
+  ErrCircuitStopped  = errors.New("circuit breaker has been closed")
 )
 
 const (
-  Open = iota
-  Closed
-  HalfOpen
-
   DefaultOpenTimerDuration                 = 3 * time.Second
   DefaultHalfOpenTimerDuration             = 2 * time.Second
   DefaultHalfOpenConsecutiveSuccess uint32 = 3
@@ -30,13 +39,42 @@ const (
 type CircuitBreaker struct {
   name                         string
   openDuration                 time.Duration
+  currentOpenDuration          int64
+  openCycles                   uint32
+  backoffMultiplier            float64
+  backoffMax                   time.Duration
+  backoffJitter                float64
   halfOpenStrategy             strategy.Strategy
+  newStrategy                  func(clk clock.Clock) strategy.Strategy
+  halfOpenInterval             time.Duration
+  halfOpenSuccess              uint32
+  clock                        clock.Clock
   consecutiveFailures          uint32
   consecutiveFailuresThreshold uint32
-  state                        uint32
-  openHooks                    []OnStateChangeHook
-  halfOpenHooks                []OnStateChangeHook
-  closeHooks                   []OnStateChangeHook
+  window                       failureWindow
+  newWindow                    func(clk clock.Clock) failureWindow
+  windowMinCalls               uint64
+  failureRate                  uint64
+  slowCallThreshold            time.Duration
+  slowCallRate                 uint64
+  isFailure                    FailurePredicate
+  fallback                     Fallback
+  fallbackOnFailure            bool
+  recoverPanics                bool
+  repanic                      bool
+  state                        State
+  stateSince                   int64
+  consecutiveSuccesses         uint32
+  totalSuccesses               uint64
+  totalFailures                uint64
+  totalRejections              uint64
+  totalSlowCalls               uint64
+  generation                   uint64
+  openTimer                    clock.Timer
+  openTimerLock                sync.Mutex
+  listeners                    hookList[Listener]
+  fallbackHooks                hookList[OnFallbackHook]
+  hookQueue                    *hookQueue
 }
 
 func NewCircuitBreaker(name string, opts ...Options) *CircuitBreaker {
@@ -44,111 +82,631 @@ func NewCircuitBreaker(name string, opts ...Options) *CircuitBreaker {
     name:                         name,
     openDuration:                 DefaultOpenTimerDuration,
     consecutiveFailuresThreshold: 5,
-    halfOpenStrategy: strategy.NewTimerStrategy(
-      DefaultHalfOpenTimerDuration,
-      DefaultHalfOpenConsecutiveSuccess),
-    state:         Closed,
-    openHooks:     []OnStateChangeHook{},
-    halfOpenHooks: []OnStateChangeHook{},
-    closeHooks:    []OnStateChangeHook{},
+    halfOpenInterval:             DefaultHalfOpenTimerDuration,
+    halfOpenSuccess:              DefaultHalfOpenConsecutiveSuccess,
+    clock:                        clock.New(),
+    state:                        Closed,
   }
 
   for _, apply := range opts {
     apply(c)
   }
+
+  // the components that depend on the clock are created once all the options are applied
+  if c.newStrategy != nil {
+    c.halfOpenStrategy = c.newStrategy(c.clock)
+  } else if c.halfOpenStrategy == nil {
+    c.halfOpenStrategy = strategy.NewTimerStrategy(
+      c.halfOpenInterval,
+      c.halfOpenSuccess,
+      strategy.WithClock(c.clock))
+  }
+  if c.newWindow != nil {
+    c.window = c.newWindow(c.clock)
+  }
+  c.stateSince = c.clock.Now().UnixNano()
   return c
 }
 
 func (c *CircuitBreaker) Do(op Op) error {
-  if c.state == Closed {
-    return c.doClose(op)
+  return c.do(context.Background(), op)
+}
+
+// DoContext is like Do, but the context is given to the operation. If the context is already
+// done, the operation is not called and the context error is returned. If the circuit is also
+// open at that moment, the returned error matches both ErrCircuitOpen and the context error.
+// An operation that fails because the caller canceled the context is not counted as a failure.
+func (c *CircuitBreaker) DoContext(ctx context.Context, op OpContext) error {
+  if err := c.contextDone(ctx); err != nil {
+    return err
+  }
+  return c.do(ctx, func() error {
+    return op(ctx)
+  })
+}
+
+// DoDeferred is like DoContext for the calls whose outcome is only known later, like a stream:
+// `op` only starts the call. If it fails, its error is counted as the outcome, otherwise the
+// outcome is counted once given to `done`, which must always be called. While half-open, the
+// call is the probe of the strategy until its outcome is given to `done`, and starting it is
+// not counted as a success. The outcome of a call is dropped if the state changed since it
+// started. There is no result to replace, so the fallback is not called.
+func (c *CircuitBreaker) DoDeferred(ctx context.Context, op OpContext) (done func(err error), err error) {
+  if err = c.contextDone(ctx); err != nil {
+    return nil, err
+  }
+  generation := atomic.LoadUint64(&c.generation)
+  if r, ok := c.halfOpenStrategy.(strategy.Recorder); ok && c.loadState() == HalfOpen {
+    return c.doDeferredHalfOpen(ctx, r, generation, op)
+  }
+
+  started := false
+  err = c.dispatch(ctx, func() error {
+    if err := op(ctx); err != nil {
+      return err
+    }
+    started = true
+    return strategy.ErrIgnored
+  })
+  c.rethrow(err)
+  if !started {
+    return nil, err
+  }
+  return deferredDone(func(err error) {
+    c.record(ctx, generation, err)
+  }), nil
+}
+
+// doDeferredHalfOpen starts the call as the probe of the strategy, which keeps it in flight
+// until its outcome is recorded
+func (c *CircuitBreaker) doDeferredHalfOpen(ctx context.Context, r strategy.Recorder, generation uint64, op OpContext) (func(err error), error) {
+  if err := r.Acquire(); err != nil {
+    atomic.AddUint64(&c.totalRejections, 1)
+    return nil, err
+  }
+
+  // release the slot if the operation panics, otherwise no other call would ever be allowed
+  completed := false
+  defer func() {
+    if !completed {
+      r.Record(strategy.ErrIgnored)
+    }
+  }()
+  err := c.call(func() error {
+    return op(ctx)
+  })
+  completed = true
+
+  if err != nil {
+    c.recordHalfOpen(ctx, r, generation, err)
+    c.rethrow(err)
+    return nil, err
+  }
+  return deferredDone(func(err error) {
+    c.recordHalfOpen(ctx, r, generation, err)
+  }), nil
+}
+
+// deferredDone returns a function recording the outcome of a call only once
+func deferredDone(record func(err error)) func(err error) {
+  var once sync.Once
+  return func(err error) {
+    once.Do(func() {
+      record(err)
+    })
   }
-  if c.state == Open {
+}
+
+func (c *CircuitBreaker) contextDone(ctx context.Context) error {
+  err := ctx.Err()
+  if err != nil && c.isOpen() {
+    return &rejectionError{rejection: ErrCircuitOpen, err: err}
+  }
+  return err
+}
+
+func (c *CircuitBreaker) do(ctx context.Context, op Op) error {
+  err := c.dispatch(ctx, op)
+  c.rethrow(err)
+  return c.fallbackFor(ctx, err)
+}
+
+func (c *CircuitBreaker) dispatch(ctx context.Context, op Op) error {
+  switch c.loadState() {
+  case Closed:
+    return c.doClose(ctx, op)
+  case Open, ForcedOpen:
     return c.doOpen(op)
+  case HalfOpen:
+    return c.doHalfOpen(ctx, op)
+  case ForcedClosed:
+    return c.call(op)
+  case Stopped:
+    return ErrCircuitStopped
+  default:
+    return op()
   }
-  return c.doHalfOpen(op)
 }
 
 func (c *CircuitBreaker) doOpen(_ Op) error {
+  atomic.AddUint64(&c.totalRejections, 1)
   return ErrCircuitOpen
 }
 
-func (c *CircuitBreaker) doClose(op Op) (err error) {
-  err = op()
-  if err == nil {
-    atomic.StoreUint32(&c.consecutiveFailures, 0)
+func (c *CircuitBreaker) doClose(ctx context.Context, op Op) (err error) {
+  start := c.startCall()
+  err = c.call(op)
+  c.recordClose(ctx, err, c.isSlow(start))
+  return
+}
+
+func (c *CircuitBreaker) call(op Op) (err error) {
+  if c.recoverPanics {
+    defer c.recoverPanic(&err)
+  }
+  return op()
+}
+
+func (c *CircuitBreaker) recoverPanic(err *error) {
+  if r := recover(); r != nil {
+    *err = &PanicError{Value: r, Stack: debug.Stack()}
+  }
+}
+
+// rethrow panics again once the panic of an operation has been recorded as a failure,
+// when the breaker is not supposed to return it as an error
+func (c *CircuitBreaker) rethrow(err error) {
+  if !c.repanic || err == nil {
+    return
+  }
+  if pe, ok := err.(*PanicError); ok {
+    panic(pe.Value)
+  }
+}
+
+// startCall returns the time at which a call started, but only when
+// it is needed to detect slow calls, since time.Now is not free
+func (c *CircuitBreaker) startCall() time.Time {
+  if c.slowCallThreshold == 0 {
+    return time.Time{}
+  }
+  return c.clock.Now()
+}
+
+func (c *CircuitBreaker) isSlow(start time.Time) bool {
+  return c.slowCallThreshold > 0 && c.clock.Now().Sub(start) > c.slowCallThreshold
+}
+
+func (c *CircuitBreaker) recordClose(ctx context.Context, err error, slow bool) {
+  // the errors that are not failures are returned to the caller, but not counted at all
+  if err != nil && !c.countsAsFailure(ctx, err) {
     return
   }
-  cf := atomic.AddUint32(&c.consecutiveFailures, 1)
+
+  // unless the slow calls have their own rate, they are counted as failures
+  failure := err != nil || (slow && c.slowCallRate == 0)
+  cf := c.recordOutcome(failure, slow)
+
+  if c.window != nil {
+    if c.shouldTrip(c.window.record(failure, slow)) {
+      c.openCircuit(Closed, tripError(err))
+    }
+    return
+  }
+
   if cf == c.consecutiveFailuresThreshold {
-    c.openCircuit(Closed)
+    c.openCircuit(Closed, tripError(err))
   }
-  return
 }
 
-func (c *CircuitBreaker) doHalfOpen(op Op) error {
+// recordOutcome updates the counters of the calls, and returns the number of consecutive failures
+func (c *CircuitBreaker) recordOutcome(failure, slow bool) uint32 {
+  if slow {
+    atomic.AddUint64(&c.totalSlowCalls, 1)
+  }
+  if !failure {
+    atomic.AddUint64(&c.totalSuccesses, 1)
+    atomic.AddUint32(&c.consecutiveSuccesses, 1)
+    atomic.StoreUint32(&c.consecutiveFailures, 0)
+    return 0
+  }
+  atomic.AddUint64(&c.totalFailures, 1)
+  atomic.StoreUint32(&c.consecutiveSuccesses, 0)
+  return atomic.AddUint32(&c.consecutiveFailures, 1)
+}
+
+// tripError is the error given to the listeners when a call opens the circuit
+func tripError(err error) error {
+  if err == nil {
+    return ErrSlowCall
+  }
+  return err
+}
+
+func (c *CircuitBreaker) shouldTrip(wc windowCounts) bool {
+  if wc.calls == 0 || wc.calls < c.windowMinCalls {
+    return false
+  }
+  if wc.failures > 0 && wc.failures*100 >= c.failureRate*wc.calls {
+    return true
+  }
+  return c.slowCallRate > 0 && wc.slowCalls > 0 && wc.slowCalls*100 >= c.slowCallRate*wc.calls
+}
+
+func (c *CircuitBreaker) countsAsFailure(ctx context.Context, err error) bool {
+  if errors.Is(err, strategy.ErrIgnored) {
+    return false
+  }
+  // the dependency is not at fault when the caller gives up on the call
+  if ctx.Err() == context.Canceled {
+    return false
+  }
+  return c.isFailure == nil || c.isFailure(err)
+}
+
+func (c *CircuitBreaker) doHalfOpen(ctx context.Context, op Op) error {
+  if c.slowCallThreshold == 0 && c.isFailure == nil && !c.recoverPanics && ctx.Done() == nil {
+    return c.processHalfOpen(op)
+  }
+
+  // the strategy only knows about errors, so a slow call is reported to it as an error,
+  // but the caller still receives the result of its operation
+  var opErr error
+  executed := false
+  err := c.processHalfOpen(func() error {
+    executed = true
+    start := c.startCall()
+    opErr = c.call(op)
+    if opErr == nil && c.isSlow(start) {
+      return ErrSlowCall
+    }
+    return c.halfOpenOutcome(ctx, opErr)
+  })
+  if executed {
+    return opErr
+  }
+  return err
+}
+
+func (c *CircuitBreaker) processHalfOpen(op Op) error {
   err, toOpen, toClose := c.halfOpenStrategy.Process(op)
+  switch err {
+  case strategy.ErrHalfOpen:
+    atomic.AddUint64(&c.totalRejections, 1)
+  case strategy.ErrIgnored:
+  default:
+    c.recordOutcome(err != nil, err == ErrSlowCall)
+  }
+  c.leaveHalfOpen(err, toOpen, toClose)
+  return err
+}
+
+// halfOpenOutcome is the error reported to the strategy for the error of a call: a call
+// canceled by the caller is ignored, and an error that is not a failure is a success
+func (c *CircuitBreaker) halfOpenOutcome(ctx context.Context, err error) error {
+  switch {
+  case err == nil:
+    return nil
+  case errors.Is(err, strategy.ErrIgnored) || ctx.Err() == context.Canceled:
+    return strategy.ErrIgnored
+  case !c.countsAsFailure(ctx, err):
+    return nil
+  }
+  return err
+}
+
+func (c *CircuitBreaker) leaveHalfOpen(err error, toOpen, toClose bool) {
   if toOpen {
-    c.openCircuit(HalfOpen)
+    c.openCircuit(HalfOpen, err)
   } else if toClose {
     c.closeCircuit(HalfOpen)
   }
-  return err
 }
 
-func (c *CircuitBreaker) openCircuit(from uint32) {
-  if atomic.CompareAndSwapUint32(&c.state, from, Open) {
-    // c.openCancelFunc()
-    // c.openCtx, c.openCancelFunc = context.WithCancel(context.Background())
-    go func() {
-      openDelayDone := time.After(c.openDuration)
-      <-openDelayDone
+// record counts the outcome of a call started by DoDeferred, unless the state changed since
+// the call started
+func (c *CircuitBreaker) record(ctx context.Context, generation uint64, err error) {
+  if atomic.LoadUint64(&c.generation) != generation {
+    return
+  }
+  switch c.loadState() {
+  case Closed:
+    c.recordClose(ctx, err, false)
+  case HalfOpen:
+    // the strategy is not a Recorder and let the call through without a slot,
+    // so only a failure can change the state
+    if err = c.halfOpenOutcome(ctx, err); err != strategy.ErrIgnored {
+      c.recordOutcome(err != nil, false)
+      c.leaveHalfOpen(err, err != nil, false)
+    }
+  }
+}
+
+// recordHalfOpen releases the slot of the probe started by DoDeferred and counts its outcome,
+// unless the circuit left the half-open state since, in which case the strategy is reset
+func (c *CircuitBreaker) recordHalfOpen(ctx context.Context, r strategy.Recorder, generation uint64, err error) {
+  if atomic.LoadUint64(&c.generation) != generation {
+    return
+  }
+  err = c.halfOpenOutcome(ctx, err)
+  toOpen, toClose := r.Record(err)
+  if err != strategy.ErrIgnored {
+    c.recordOutcome(err != nil, false)
+  }
+  c.leaveHalfOpen(err, toOpen, toClose)
+}
+
+func (c *CircuitBreaker) shouldFallback(ctx context.Context, err error) bool {
+  if err == nil || c.loadState() == Disabled {
+    return false
+  }
+  if IsRejection(err) {
+    return true
+  }
+  return c.fallbackOnFailure && c.countsAsFailure(ctx, err)
+}
+
+// fallbackFor returns the result of the fallback when there is one to call,
+// otherwise it returns the error unchanged
+func (c *CircuitBreaker) fallbackFor(ctx context.Context, err error) error {
+  if c.fallback == nil || !c.shouldFallback(ctx, err) {
+    return err
+  }
+  c.execFallbackHooks(err)
+  return c.fallback(err)
+}
+
+// PanicError is returned when the operation panicked and the breaker was created with
+// WithPanicRecovery. The panic is counted as a failure.
+type PanicError struct {
+  Value interface{}
+  Stack []byte
+}
+
+func (e *PanicError) Error() string {
+  return fmt.Sprintf("circuit breaker operation panicked: %v", e.Value)
+}
+
+// rejectionError is returned when the circuit rejected a call for which the context
+// was already done, so that it matches both errors with errors.Is.
+type rejectionError struct {
+  rejection error
+  err       error
+}
+
+func (e *rejectionError) Error() string {
+  return e.rejection.Error() + ": " + e.err.Error()
+}
+
+func (e *rejectionError) Is(target error) bool {
+  return errors.Is(e.rejection, target) || errors.Is(e.err, target)
+}
+
+func (e *rejectionError) Unwrap() error {
+  return e.err
+}
+
+func (c *CircuitBreaker) loadState() State {
+  return State(atomic.LoadUint32((*uint32)(&c.state)))
+}
+
+func (c *CircuitBreaker) casState(from, to State) bool {
+  return atomic.CompareAndSwapUint32((*uint32)(&c.state), uint32(from), uint32(to))
+}
+
+func (c *CircuitBreaker) isOpen() bool {
+  state := c.loadState()
+  return state == Open || state == ForcedOpen
+}
+
+func (c *CircuitBreaker) openCircuit(from State, err error) {
+  c.openCircuitFor(from, 0, err)
+}
+
+// openCircuitFor opens the circuit for `openDuration`, or for the next open duration if it is 0
+func (c *CircuitBreaker) openCircuitFor(from State, openDuration time.Duration, err error) bool {
+  if c.casState(from, Open) {
+    generation := atomic.AddUint64(&c.generation, 1)
+    if openDuration == 0 {
+      openDuration = c.nextOpenDuration(from)
+    }
+    atomic.StoreInt64(&c.currentOpenDuration, int64(openDuration))
+
+    timer := c.clock.AfterFunc(openDuration, func() {
+      // the state was changed manually since the circuit opened,
+      // the timer belongs to an open period that is over
+      if atomic.LoadUint64(&c.generation) != generation {
+        return
+      }
       c.halfOpenStrategy.Reset(0)
       c.halfOpenCircuit(Open)
-    }()
-    execHooks(c.openHooks)
+    })
+
+    c.openTimerLock.Lock()
+    if atomic.LoadUint64(&c.generation) == generation {
+      c.openTimer = timer
+    } else {
+      // the state was changed, or the breaker closed, before the timer was stored,
+      // so setState could not stop it
+      timer.Stop()
+    }
+    c.openTimerLock.Unlock()
+    c.emit(from, Open, err)
+    return true
   }
+  return false
 }
 
-func (c *CircuitBreaker) halfOpenCircuit(from uint32) {
-  if atomic.CompareAndSwapUint32(&c.state, from, HalfOpen) {
-    execHooks(c.halfOpenHooks)
+// tripFor opens the circuit for `openDuration` in place of the open duration of the
+// circuit breaker, if it is closed or half-open
+func (c *CircuitBreaker) tripFor(openDuration time.Duration, err error) {
+  if !c.openCircuitFor(Closed, openDuration, err) {
+    c.openCircuitFor(HalfOpen, openDuration, err)
   }
 }
-func (c *CircuitBreaker) closeCircuit(from uint32) {
-  if atomic.CompareAndSwapUint32(&c.state, from, Closed) {
-    execHooks(c.closeHooks)
+
+// nextOpenDuration computes how long the circuit stays open. With a backoff, the duration
+// is multiplied each time the circuit opens again from the half-open state.
+func (c *CircuitBreaker) nextOpenDuration(from State) time.Duration {
+  if c.backoffMultiplier == 0 {
+    return c.openDuration
+  }
+
+  var cycles uint32
+  if from == HalfOpen {
+    cycles = atomic.AddUint32(&c.openCycles, 1)
+  }
+  d := float64(c.openDuration) * math.Pow(c.backoffMultiplier, float64(cycles))
+  if c.backoffJitter > 0 {
+    d += d * c.backoffJitter * (2*rand.Float64() - 1)
   }
+  if c.backoffMax > 0 && d > float64(c.backoffMax) {
+    d = float64(c.backoffMax)
+  }
+  return time.Duration(d)
 }
 
-func (c *CircuitBreaker) CurrentState() string {
-  if c.state == Open {
-    return "open"
+// OpenDuration returns how long the circuit stays open during the current open period,
+// or during the last one if the circuit is not open.
+func (c *CircuitBreaker) OpenDuration() time.Duration {
+  if d := atomic.LoadInt64(&c.currentOpenDuration); d > 0 {
+    return time.Duration(d)
   }
-  if c.state == Closed {
-    return "close"
+  return c.openDuration
+}
+
+func (c *CircuitBreaker) halfOpenCircuit(from State) {
+  if c.casState(from, HalfOpen) {
+    c.emit(from, HalfOpen, nil)
+  }
+}
+func (c *CircuitBreaker) closeCircuit(from State) {
+  if c.casState(from, Closed) {
+    // start counting from scratch, otherwise the failures recorded
+    // before the circuit opened would count against the new closed period
+    atomic.StoreUint32(&c.consecutiveFailures, 0)
+    atomic.StoreUint32(&c.openCycles, 0)
+    if c.window != nil {
+      c.window.reset()
+    }
+    c.emit(from, Closed, nil)
+  }
+}
+
+// ForceOpen rejects all the calls until the state is changed manually again.
+func (c *CircuitBreaker) ForceOpen() {
+  c.setState(ForcedOpen)
+}
+
+// ForceClose lets all the calls through, and never opens the circuit
+// until the state is changed manually again.
+func (c *CircuitBreaker) ForceClose() {
+  c.setState(ForcedClosed)
+}
+
+// Disable bypasses the circuit breaker entirely: the operations are called
+// directly, without any bookkeeping, fallback or panic recovery.
+func (c *CircuitBreaker) Disable() {
+  c.setState(Disabled)
+}
+
+// Reset closes the circuit and clears the failures recorded so far.
+// It is also the way to leave a forced state.
+func (c *CircuitBreaker) Reset() {
+  atomic.StoreUint32(&c.consecutiveFailures, 0)
+  atomic.StoreUint32(&c.consecutiveSuccesses, 0)
+  atomic.StoreUint32(&c.openCycles, 0)
+  if c.window != nil {
+    c.window.reset()
+  }
+  c.setState(Closed)
+}
+
+// Close stops the circuit breaker: its pending state transition is canceled, and the calls
+// made after Close return ErrCircuitStopped. Calling Close more than once has no effect.
+func (c *CircuitBreaker) Close() {
+  c.setState(Stopped)
+  if c.hookQueue != nil {
+    c.hookQueue.close()
+  }
+}
+
+// setState changes the state manually and cancels the pending transition to half-open,
+// unless the circuit breaker has been stopped
+func (c *CircuitBreaker) setState(state State) {
+  var from State
+  for {
+    from = c.loadState()
+    if from == Stopped {
+      return
+    }
+    atomic.AddUint64(&c.generation, 1)
+    if c.casState(from, state) {
+      break
+    }
+  }
+
+  c.openTimerLock.Lock()
+  if c.openTimer != nil {
+    c.openTimer.Stop()
+    c.openTimer = nil
+  }
+  c.openTimerLock.Unlock()
+
+  if from != state {
+    c.emit(from, state, nil)
   }
-  return "halfopen"
 }
 
-func (c *CircuitBreaker) RegisterOnOpenHooks(h OnStateChangeHook) {
-  c.openHooks = append(c.openHooks, h)
+// Name returns the name given to NewCircuitBreaker.
+func (c *CircuitBreaker) Name() string {
+  return c.name
 }
 
-func (c *CircuitBreaker) RegisterOnCloseHooks(h OnStateChangeHook) {
-  c.closeHooks = append(c.closeHooks, h)
+// State returns the current state of the circuit.
+func (c *CircuitBreaker) State() State {
+  return c.loadState()
 }
 
-func (c *CircuitBreaker) RegisterOnHalfOpenHooks(h OnStateChangeHook) {
-  c.halfOpenHooks = append(c.halfOpenHooks, h)
+// CurrentState returns the name of the current state. It is kept for compatibility,
+// use State instead.
+func (c *CircuitBreaker) CurrentState() string {
+  switch c.loadState() {
+  case Open:
+    return "open"
+  case Closed:
+    return "close"
+  case ForcedOpen:
+    return "forcedopen"
+  case ForcedClosed:
+    return "forcedclosed"
+  case Disabled:
+    return "disabled"
+  case Stopped:
+    return "stopped"
+  }
+  return "halfopen"
 }
 
-func execHooks(hooks []OnStateChangeHook) {
-  if hooks == nil {
+func (c *CircuitBreaker) RegisterOnFallbackHooks(h OnFallbackHook) (unsubscribe func()) {
+  return c.fallbackHooks.add(h)
+}
+
+func (c *CircuitBreaker) execFallbackHooks(err error) {
+  hooks := c.fallbackHooks.load()
+  if len(hooks) == 0 {
+    return
+  }
+  if c.hookQueue != nil {
+    c.hookQueue.dispatch(func() { runFallbackHooks(hooks, err) })
     return
   }
+  runFallbackHooks(hooks, err)
+}
+
+func runFallbackHooks(hooks []*OnFallbackHook, err error) {
   for _, h := range hooks {
-    h()
+    (*h)(err)
   }
 }
 
@@ -158,21 +716,159 @@ func WithFailuresThreshold(threshold uint32) func(breaker *CircuitBreaker) {
   }
 }
 
+// WithFailureRateWindow replaces the consecutive failures threshold by a failure rate
+// computed over the outcome of the last `size` calls. The circuit opens once at least
+// `minCalls` calls were recorded and the percentage of failures is equal or greater
+// than `ratePercent`.
+func WithFailureRateWindow(size, minCalls, ratePercent uint32) func(breaker *CircuitBreaker) {
+  return func(breaker *CircuitBreaker) {
+    breaker.newWindow = func(_ clock.Clock) failureWindow {
+      return newCountWindow(size)
+    }
+    breaker.windowMinCalls = uint64(minCalls)
+    breaker.failureRate = uint64(ratePercent)
+  }
+}
+
+// WithFailureRateTimeWindow is similar to WithFailureRateWindow, but the failure rate is
+// computed over the calls made during the last `window`. The window is split in `numBuckets`
+// buckets, the oldest bucket being discarded every `window / numBuckets`.
+func WithFailureRateTimeWindow(window time.Duration, numBuckets, minCalls, ratePercent uint32) func(breaker *CircuitBreaker) {
+  return func(breaker *CircuitBreaker) {
+    breaker.newWindow = func(clk clock.Clock) failureWindow {
+      return newTimeWindow(window, numBuckets, clk)
+    }
+    breaker.windowMinCalls = uint64(minCalls)
+    breaker.failureRate = uint64(ratePercent)
+  }
+}
+
+// WithSlowCallThreshold counts the calls that take longer than `threshold` as failures,
+// even if they did not return an error. This applies to the closed and half-open states.
+func WithSlowCallThreshold(threshold time.Duration) func(breaker *CircuitBreaker) {
+  return func(breaker *CircuitBreaker) {
+    breaker.slowCallThreshold = threshold
+  }
+}
+
+// WithSlowCallRateThreshold stops counting the slow calls as failures in the closed state,
+// and instead opens the circuit when the percentage of slow calls in the failure rate window
+// is equal or greater than `ratePercent`. It requires a failure rate window and a slow call
+// threshold. In the half-open state, slow calls are always treated as failures.
+func WithSlowCallRateThreshold(ratePercent uint32) func(breaker *CircuitBreaker) {
+  return func(breaker *CircuitBreaker) {
+    breaker.slowCallRate = uint64(ratePercent)
+  }
+}
+
+// WithFailurePredicate decides which errors returned by an operation are failures. The errors
+// for which the predicate returns false are still returned to the caller, but they are not
+// counted in the closed state, and are reported as a success to the half-open strategy.
+func WithFailurePredicate(isFailure FailurePredicate) func(breaker *CircuitBreaker) {
+  return func(breaker *CircuitBreaker) {
+    breaker.isFailure = isFailure
+  }
+}
+
+// IgnoreErrors returns a FailurePredicate for which the errors matching one of `errs`
+// (using errors.Is) are not failures.
+func IgnoreErrors(errs ...error) FailurePredicate {
+  return func(err error) bool {
+    for _, e := range errs {
+      if errors.Is(err, e) {
+        return false
+      }
+    }
+    return true
+  }
+}
+
+// IgnoreContextCanceled is a FailurePredicate for which a canceled context is not a failure,
+// since the caller gave up on the call and the dependency is not at fault.
+func IgnoreContextCanceled(err error) bool {
+  return !errors.Is(err, context.Canceled)
+}
+
+// WithFallback calls `fallback` with the original error when the circuit rejects a call, and
+// returns its result to the caller instead of the error. The rejection error is either
+// ErrCircuitOpen, strategy.ErrHalfOpen, or ErrCircuitStopped once the circuit breaker is
+// closed (or evicted by a KeyedCircuitBreaker).
+func WithFallback(fallback Fallback) func(breaker *CircuitBreaker) {
+  return func(breaker *CircuitBreaker) {
+    breaker.fallback = fallback
+  }
+}
+
+// WithFallbackOnFailure also calls the fallbacks when the operation returns
+// an error counted as a failure.
+func WithFallbackOnFailure() func(breaker *CircuitBreaker) {
+  return func(breaker *CircuitBreaker) {
+    breaker.fallbackOnFailure = true
+  }
+}
+
+// WithPanicRecovery recovers the panics of the operations and counts them as failures. If
+// `repanic` is true, the operation panics again with the same value once the failure has been
+// recorded, otherwise a *PanicError carrying the value and the stack is returned.
+func WithPanicRecovery(repanic bool) func(breaker *CircuitBreaker) {
+  return func(breaker *CircuitBreaker) {
+    breaker.recoverPanics = true
+    breaker.repanic = repanic
+  }
+}
+
 func WithOpenDuration(d time.Duration) func(breaker *CircuitBreaker) {
   return func(breaker *CircuitBreaker) {
     breaker.openDuration = d
   }
 }
 
+// WithOpenBackoff multiplies the open duration by `multiplier` each time the circuit opens
+// again after a failed half-open period, up to `max` (no limit if 0). The duration is randomized
+// by +/- `jitter` percent (between 0 and 1), and goes back to the open duration once the
+// circuit closes.
+func WithOpenBackoff(multiplier float64, max time.Duration, jitter float64) func(breaker *CircuitBreaker) {
+  return func(breaker *CircuitBreaker) {
+    breaker.backoffMultiplier = multiplier
+    breaker.backoffMax = max
+    breaker.backoffJitter = jitter
+  }
+}
+
+// WithClock replaces the source of time of the circuit breaker and of its default strategy,
+// see clock.Fake to control the time in tests. A custom strategy needs to be given the
+// clock on its own.
+func WithClock(clk clock.Clock) func(breaker *CircuitBreaker) {
+  return func(breaker *CircuitBreaker) {
+    breaker.clock = clk
+  }
+}
+
 func WithTimerStrategy(interval time.Duration, consecutiveSuccess uint32) func(breaker *CircuitBreaker) {
-  s := strategy.NewTimerStrategy(interval, consecutiveSuccess)
   return func(breaker *CircuitBreaker) {
-    breaker.halfOpenStrategy = s
+    breaker.halfOpenStrategy = nil
+    breaker.newStrategy = nil
+    breaker.halfOpenInterval = interval
+    breaker.halfOpenSuccess = consecutiveSuccess
   }
 }
 
+// WithCustomStrategy gives the strategy `s` to the circuit breaker. A strategy keeps the state
+// of the half-open circuit, so `s` must not be shared: the options given to a KeyedCircuitBreaker,
+// a Registry, WithPerHost, WithRoutes or a grpccircuit.Interceptor create many circuit breakers,
+// use WithCustomStrategyFactory with them.
 func WithCustomStrategy(s strategy.Strategy) func(breaker *CircuitBreaker) {
   return func(breaker *CircuitBreaker) {
     breaker.halfOpenStrategy = s
+    breaker.newStrategy = nil
+  }
+}
+
+// WithCustomStrategyFactory creates the strategy of each circuit breaker with `newStrategy`,
+// given the clock of the circuit breaker.
+func WithCustomStrategyFactory(newStrategy func(clk clock.Clock) strategy.Strategy) func(breaker *CircuitBreaker) {
+  return func(breaker *CircuitBreaker) {
+    breaker.halfOpenStrategy = nil
+    breaker.newStrategy = newStrategy
   }
 }
@@ -4,6 +4,7 @@ import (
   "context"
   "errors"
   "fmt"
+  "math"
   "runtime"
   "sync"
   "sync/atomic"
@@ -11,6 +12,7 @@ import (
   "time"
 
   "github.com/golang/mock/gomock"
+  "github.com/ocampeau/gutils/circuitbreaker/clock"
   "github.com/ocampeau/gutils/circuitbreaker/strategy"
   "github.com/ocampeau/gutils/circuitbreaker/strategy/mocks"
   "github.com/stretchr/testify/assert"
@@ -82,15 +84,16 @@ func TestCircuitShouldHalfOpenOnceTimerExpire(t *testing.T) {
 
   for _, testDuration := range durations {
     t.Run(fmt.Sprintf("with duration %s", testDuration.String()), func(t *testing.T) {
-      cb := NewCircuitBreaker("test", WithOpenDuration(testDuration))
+      clk := clock.NewFake(time.Unix(1000, 0))
+      cb := NewCircuitBreaker("test", WithOpenDuration(testDuration), WithClock(clk))
       cb.state = Closed
-      cb.openCircuit(Closed)
+      cb.openCircuit(Closed, nil)
 
-      // we add 5 millisecond to the timer to allow time for the synchronization of the state
-      // between the goroutines. That is to say that the state transition from open to half-open
-      // is precise at 5 milliseconds
-      <-time.After(testDuration + (10 * time.Millisecond))
-      assert.Equalf(t, HalfOpen, int(cb.state), "expected half-open but got %s", cb.CurrentState())
+      clk.Advance(testDuration - time.Nanosecond)
+      assert.Equalf(t, Open, cb.state, "expected open but got %s", cb.CurrentState())
+
+      clk.Advance(time.Nanosecond)
+      assert.Equalf(t, HalfOpen, cb.state, "expected half-open but got %s", cb.CurrentState())
     })
   }
 
@@ -104,9 +107,9 @@ func TestCircuitShouldOpenWhenHalfOpenReturnsTrue(t *testing.T) {
   s.EXPECT().Reset(gomock.Any()).AnyTimes()
   cb := NewCircuitBreaker("test", WithCustomStrategy(s))
   cb.state = HalfOpen
-  err := cb.doHalfOpen(func() error { return ErrCircuitInternal })
+  err := cb.doHalfOpen(context.Background(), func() error { return ErrCircuitInternal })
   assert.Equal(t, strategy.ErrHalfOpen, err)
-  assert.Equal(t, Open, int(cb.state))
+  assert.Equal(t, Open, cb.state)
 }
 
 func TestCircuitShouldCloseWhenHalfOpenReturnsTrue(t *testing.T) {
@@ -117,9 +120,9 @@ func TestCircuitShouldCloseWhenHalfOpenReturnsTrue(t *testing.T) {
 
   cb := NewCircuitBreaker("test", WithCustomStrategy(s))
   cb.state = HalfOpen
-  err := cb.doHalfOpen(func() error { return ErrCircuitInternal })
+  err := cb.doHalfOpen(context.Background(), func() error { return ErrCircuitInternal })
   assert.Equal(t, nil, err)
-  assert.Equal(t, Closed, int(cb.state))
+  assert.Equal(t, Closed, cb.state)
 }
 
 func TestCircuitShouldReturnErrWhenHalfOpenReturnsErr(t *testing.T) {
@@ -130,20 +133,21 @@ func TestCircuitShouldReturnErrWhenHalfOpenReturnsErr(t *testing.T) {
 
   cb := NewCircuitBreaker("test", WithCustomStrategy(s))
   cb.state = HalfOpen
-  err := cb.doHalfOpen(func() error { return ErrCircuitInternal })
+  err := cb.doHalfOpen(context.Background(), func() error { return ErrCircuitInternal })
   assert.NotNil(t, err)
-  assert.Equal(t, HalfOpen, int(cb.state))
+  assert.Equal(t, HalfOpen, cb.state)
 }
 
 func TestCircuitE2E(t *testing.T) {
-  start := time.Now()
+  clk := clock.NewFake(time.Unix(1000, 0))
+  start := clk.Now()
 
   numTimeToOpen := 0
   numTimeToHalfOpen := 0
   numTimeToClose := 0
 
   op := func() error {
-    now := time.Now().UnixMicro()
+    now := clk.Now().UnixMicro()
     // return no error for the first 2 seconds
     if now <= start.Add(2*time.Second).UnixMicro() {
       return nil
@@ -158,7 +162,7 @@ func TestCircuitE2E(t *testing.T) {
     return nil
   }
 
-  cb := NewCircuitBreaker("test", WithTimerStrategy(50*time.Millisecond, 5))
+  cb := NewCircuitBreaker("test", WithTimerStrategy(50*time.Millisecond, 5), WithClock(clk))
   cb.openDuration = 100 * time.Millisecond
   cb.RegisterOnOpenHooks(func() {
     numTimeToOpen++
@@ -170,18 +174,539 @@ func TestCircuitE2E(t *testing.T) {
     numTimeToHalfOpen++
   })
 
-  endTestTime := time.Now().Add(5 * time.Second)
+  endTestTime := clk.Now().Add(5 * time.Second)
   for {
-    if time.Now().UnixMicro() > endTestTime.UnixMicro() {
+    if clk.Now().UnixMicro() > endTestTime.UnixMicro() {
       break
     }
     cb.Do(op)
+    cb.Do(op)
+    clk.Advance(time.Millisecond)
   }
 
   assert.Equal(t, numTimeToHalfOpen, numTimeToOpen)
   assert.Equal(t, numTimeToClose, 1)
 }
 
+// slowOp is an operation that takes `d` to complete according to the fake clock
+func slowOp(clk *clock.Fake, d time.Duration) Op {
+  return func() error {
+    clk.Advance(d)
+    return nil
+  }
+}
+
+func TestCircuitShouldCountSlowCallsAsFailures(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  cb := NewCircuitBreaker("test",
+    WithClock(clk),
+    WithFailuresThreshold(3),
+    WithSlowCallThreshold(time.Millisecond))
+
+  for i := 0; i < 3; i++ {
+    // the caller still receives the result of its operation
+    assert.Nil(t, cb.Do(slowOp(clk, 5*time.Millisecond)))
+  }
+  assert.Equal(t, Open, cb.state)
+}
+
+func TestCircuitShouldOpenWhenSlowCallRateIsReached(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  cb := NewCircuitBreaker("test",
+    WithClock(clk),
+    WithFailureRateWindow(4, 4, 50),
+    WithSlowCallThreshold(time.Millisecond),
+    WithSlowCallRateThreshold(75))
+
+  cb.Do(slowOp(clk, 5*time.Millisecond))
+  cb.Do(slowOp(clk, 5*time.Millisecond))
+  cb.Do(slowOp(clk, 0))
+  assert.Equal(t, Closed, cb.state)
+  assert.Equal(t, windowCounts{calls: 3, slowCalls: 2}, cb.window.counts(), "slow calls should not be failures")
+
+  cb.Do(slowOp(clk, 5*time.Millisecond))
+  assert.Equal(t, Open, cb.state)
+}
+
+func TestCircuitShouldReopenWhenHalfOpenCallIsSlow(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  cb := NewCircuitBreaker("test",
+    WithClock(clk),
+    WithTimerStrategy(time.Hour, 1),
+    WithSlowCallThreshold(time.Millisecond))
+  cb.state = HalfOpen
+
+  assert.Nil(t, cb.Do(slowOp(clk, 5*time.Millisecond)))
+  assert.Equal(t, Open, cb.state)
+}
+
+func TestCircuitShouldCloseWhenHalfOpenCallIsFast(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  cb := NewCircuitBreaker("test",
+    WithClock(clk),
+    WithTimerStrategy(time.Hour, 1),
+    WithSlowCallThreshold(time.Millisecond))
+  cb.state = HalfOpen
+
+  assert.Nil(t, cb.Do(slowOp(clk, time.Millisecond)))
+  assert.Equal(t, Closed, cb.state)
+}
+
+func TestCircuitShouldNotCountIgnoredErrors(t *testing.T) {
+  errNotFound := errors.New("not found")
+  cb := NewCircuitBreaker("test",
+    WithFailuresThreshold(2),
+    WithFailurePredicate(IgnoreErrors(errNotFound)))
+
+  for i := 0; i < 5; i++ {
+    err := cb.Do(func() error { return fmt.Errorf("wrapped: %w", errNotFound) })
+    assert.ErrorIs(t, err, errNotFound)
+  }
+  assert.Equal(t, Closed, cb.state)
+  assert.Equal(t, uint32(0), cb.consecutiveFailures)
+
+  // an ignored error does not reset the consecutive failures either
+  cb.Do(func() error { return ErrCircuitInternal })
+  cb.Do(func() error { return errNotFound })
+  cb.Do(func() error { return ErrCircuitInternal })
+  assert.Equal(t, Open, cb.state)
+}
+
+func TestCircuitShouldNotCountContextCanceled(t *testing.T) {
+  cb := NewCircuitBreaker("test",
+    WithFailureRateWindow(2, 2, 50),
+    WithFailurePredicate(IgnoreContextCanceled))
+
+  for i := 0; i < 5; i++ {
+    cb.Do(func() error { return context.Canceled })
+  }
+  assert.Equal(t, Closed, cb.state)
+  assert.Equal(t, windowCounts{}, cb.window.counts())
+}
+
+func TestCircuitHalfOpenShouldUseFailurePredicate(t *testing.T) {
+  errNotFound := errors.New("not found")
+  cb := NewCircuitBreaker("test",
+    WithCustomStrategy(strategy.NewTimerStrategy(time.Hour, 1)),
+    WithFailurePredicate(IgnoreErrors(errNotFound)))
+  cb.state = HalfOpen
+
+  err := cb.Do(func() error { return errNotFound })
+  assert.Equal(t, errNotFound, err)
+  assert.Equal(t, Closed, cb.state)
+}
+
+func TestCircuitHalfOpenShouldNotCountCanceledCalls(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithTimerStrategy(0, 3))
+  cb.state = HalfOpen
+
+  for i := 0; i < 3; i++ {
+    ctx, cancel := context.WithCancel(context.Background())
+    err := cb.DoContext(ctx, func(ctx context.Context) error {
+      cancel()
+      return ctx.Err()
+    })
+    assert.Equal(t, context.Canceled, err)
+  }
+  assert.Equal(t, HalfOpen, cb.state)
+  assert.Equal(t, uint32(0), cb.consecutiveSuccesses)
+  assert.Equal(t, uint64(0), cb.Stats().Successes)
+  assert.Equal(t, uint64(0), cb.Stats().Failures)
+
+  // the slot is released, so the next probe goes through
+  cb.Do(func() error { return nil })
+  assert.Equal(t, uint64(1), cb.Stats().Successes)
+}
+
+func TestDoContextShouldNotCallOpWhenContextIsDone(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+
+  called := false
+  op := func(ctx context.Context) error {
+    called = true
+    return nil
+  }
+
+  cb := NewCircuitBreaker("test")
+  err := cb.DoContext(ctx, op)
+  assert.Equal(t, context.Canceled, err)
+  assert.False(t, called)
+
+  cb.state = Open
+  err = cb.DoContext(ctx, op)
+  assert.ErrorIs(t, err, ErrCircuitOpen)
+  assert.ErrorIs(t, err, context.Canceled)
+  assert.False(t, called)
+}
+
+func TestDoContextShouldNotCountCallerCancellation(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailuresThreshold(1))
+
+  ctx, cancel := context.WithCancel(context.Background())
+  err := cb.DoContext(ctx, func(ctx context.Context) error {
+    cancel()
+    return ctx.Err()
+  })
+  assert.Equal(t, context.Canceled, err)
+  assert.Equal(t, Closed, cb.state)
+
+  ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+  defer cancel()
+  err = cb.DoContext(ctx, func(ctx context.Context) error {
+    <-ctx.Done()
+    return ctx.Err()
+  })
+  assert.Equal(t, context.DeadlineExceeded, err)
+  assert.Equal(t, Open, cb.state, "a deadline exceeded is a failure of the dependency")
+}
+
+func TestCircuitShouldCallFallbackOnRejection(t *testing.T) {
+  var fallbackErr, hookErr error
+  cb := NewCircuitBreaker("test", WithFallback(func(err error) error {
+    fallbackErr = err
+    return nil
+  }))
+  cb.RegisterOnFallbackHooks(func(err error) {
+    hookErr = err
+  })
+
+  errOp := errors.New("operation error")
+  assert.Equal(t, errOp, cb.Do(func() error { return errOp }), "fallback should not be called on failure")
+  assert.Nil(t, fallbackErr)
+
+  cb.state = Open
+  assert.Nil(t, cb.Do(func() error { return nil }))
+  assert.Equal(t, ErrCircuitOpen, fallbackErr)
+  assert.Equal(t, ErrCircuitOpen, hookErr)
+}
+
+func TestCircuitShouldCallFallbackOnFailure(t *testing.T) {
+  errNotFound := errors.New("not found")
+  errFallback := errors.New("fallback error")
+
+  var fallbackErr error
+  cb := NewCircuitBreaker("test",
+    WithFallbackOnFailure(),
+    WithFailurePredicate(IgnoreErrors(errNotFound)),
+    WithFallback(func(err error) error {
+      fallbackErr = err
+      return errFallback
+    }))
+
+  assert.Equal(t, errNotFound, cb.Do(func() error { return errNotFound }))
+  assert.Nil(t, fallbackErr, "fallback should not be called for an error which is not a failure")
+
+  assert.Equal(t, errFallback, cb.Do(func() error { return ErrCircuitInternal }))
+  assert.Equal(t, ErrCircuitInternal, fallbackErr)
+}
+
+func TestCircuitShouldRecoverPanicsAsFailures(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailuresThreshold(2), WithPanicRecovery(false))
+
+  err := cb.Do(func() error { panic("boom") })
+  pe, ok := err.(*PanicError)
+  assert.True(t, ok)
+  assert.Equal(t, "boom", pe.Value)
+  assert.NotEmpty(t, pe.Stack)
+  assert.Equal(t, uint32(1), cb.consecutiveFailures)
+
+  _, err = Execute(cb, func() (int, error) { panic("boom") })
+  assert.IsType(t, &PanicError{}, err)
+  assert.Equal(t, Open, cb.state)
+}
+
+func TestCircuitShouldRepanicAfterRecordingTheFailure(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailuresThreshold(1), WithPanicRecovery(true))
+
+  assert.PanicsWithValue(t, "boom", func() {
+    cb.Do(func() error { panic("boom") })
+  })
+  assert.Equal(t, Open, cb.state)
+}
+
+func TestCircuitShouldReopenWhenHalfOpenCallPanics(t *testing.T) {
+  cb := NewCircuitBreaker("test",
+    WithCustomStrategy(strategy.NewTimerStrategy(0, 1)),
+    WithPanicRecovery(false))
+  cb.state = HalfOpen
+
+  err := cb.Do(func() error { panic("boom") })
+  assert.IsType(t, &PanicError{}, err)
+  assert.Equal(t, Open, cb.state)
+}
+
+func TestCircuitForceOpenShouldRejectUntilReset(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  cb := NewCircuitBreaker("test", WithOpenDuration(time.Millisecond), WithClock(clk))
+  cb.openCircuit(Closed, nil)
+  cb.ForceOpen()
+
+  // the open timer should not move a forced state to half-open
+  clk.Advance(time.Second)
+  assert.Equal(t, ForcedOpen, cb.loadState())
+  assert.Equal(t, "forcedopen", cb.CurrentState())
+  assert.Equal(t, ErrCircuitOpen, cb.Do(func() error { return nil }))
+
+  var numClose int
+  cb.RegisterOnCloseHooks(func() {
+    numClose++
+  })
+  cb.Reset()
+  assert.Equal(t, Closed, cb.loadState())
+  assert.Equal(t, 1, numClose)
+  assert.Nil(t, cb.Do(func() error { return nil }))
+}
+
+func TestDoDeferredShouldCountTheOutcomeOnceDone(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailuresThreshold(2))
+
+  done, err := cb.DoDeferred(context.Background(), func(ctx context.Context) error { return nil })
+  assert.Nil(t, err)
+  assert.Equal(t, uint64(0), cb.Stats().Successes, "starting a call should not be counted")
+
+  done(ErrCircuitInternal)
+  done(nil)
+  assert.Equal(t, uint64(1), cb.Stats().Failures)
+  assert.Equal(t, uint64(0), cb.Stats().Successes, "the outcome should be counted once")
+
+  // a call failing to start is counted right away
+  done, err = cb.DoDeferred(context.Background(), func(ctx context.Context) error { return ErrCircuitInternal })
+  assert.Nil(t, done)
+  assert.Equal(t, ErrCircuitInternal, err)
+  assert.Equal(t, Open, cb.State())
+
+  _, err = cb.DoDeferred(context.Background(), func(ctx context.Context) error { return nil })
+  assert.Equal(t, ErrCircuitOpen, err)
+}
+
+func TestDoDeferredHalfOpenShouldHoldTheProbe(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  cb := NewCircuitBreaker("test", WithClock(clk), WithTimerStrategy(2*time.Second, 2))
+  cb.state = HalfOpen
+  start := func() (func(error), error) {
+    return cb.DoDeferred(context.Background(), func(ctx context.Context) error { return nil })
+  }
+
+  done, err := start()
+  assert.Nil(t, err)
+  for i := 0; i < 50; i++ {
+    _, err := start()
+    assert.Equal(t, strategy.ErrHalfOpen, err, "a single probe should be in flight")
+  }
+  assert.Equal(t, strategy.ErrHalfOpen, cb.Do(func() error { return nil }))
+
+  done(nil)
+  assert.Equal(t, HalfOpen, cb.State())
+  _, err = start()
+  assert.Equal(t, strategy.ErrHalfOpen, err, "the next probe should wait for the interval")
+
+  clk.Advance(2 * time.Second)
+  done, err = start()
+  assert.Nil(t, err)
+  done(nil)
+  assert.Equal(t, Closed, cb.State())
+  assert.Equal(t, uint64(2), cb.Stats().Successes)
+
+  // a failing probe opens the circuit again
+  cb.state = HalfOpen
+  cb.halfOpenStrategy.Reset(0)
+  done, _ = start()
+  done(ErrCircuitInternal)
+  assert.Equal(t, Open, cb.State())
+}
+
+func TestDoDeferredShouldDropTheOutcomeOfCallsStartedBeforeTheCircuitOpened(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  cb := NewCircuitBreaker("test",
+    WithClock(clk),
+    WithFailuresThreshold(1),
+    WithOpenDuration(time.Second),
+    WithTimerStrategy(2*time.Second, 1))
+
+  var calls []func(error)
+  for i := 0; i < 3; i++ {
+    done, err := cb.DoDeferred(context.Background(), func(ctx context.Context) error { return nil })
+    assert.Nil(t, err)
+    calls = append(calls, done)
+  }
+  cb.Do(func() error { return ErrCircuitInternal })
+  clk.Advance(time.Second)
+  assert.Equal(t, HalfOpen, cb.State())
+
+  for _, done := range calls {
+    done(nil)
+  }
+  assert.Equal(t, HalfOpen, cb.State())
+  assert.Equal(t, uint64(0), cb.Stats().Successes)
+}
+
+func TestDoDeferredHalfOpenShouldReleaseTheProbeOnPanic(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithTimerStrategy(time.Hour, 1))
+  cb.state = HalfOpen
+
+  assert.Panics(t, func() {
+    cb.DoDeferred(context.Background(), func(ctx context.Context) error { panic("boom") })
+  })
+  done, err := cb.DoDeferred(context.Background(), func(ctx context.Context) error { return nil })
+  assert.Nil(t, err)
+  done(nil)
+  assert.Equal(t, Closed, cb.State())
+}
+
+func TestCircuitForceCloseShouldNeverOpen(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailuresThreshold(1))
+  cb.ForceClose()
+
+  for i := 0; i < 5; i++ {
+    assert.Equal(t, ErrCircuitInternal, cb.Do(func() error { return ErrCircuitInternal }))
+  }
+  assert.Equal(t, ForcedClosed, cb.state)
+  assert.Equal(t, "forcedclosed", cb.CurrentState())
+}
+
+func TestCircuitDisableShouldBypassTheBreaker(t *testing.T) {
+  cb := NewCircuitBreaker("test",
+    WithFailuresThreshold(1),
+    WithFallback(func(err error) error { return nil }),
+    WithFallbackOnFailure())
+  cb.Disable()
+
+  assert.Equal(t, ErrCircuitInternal, cb.Do(func() error { return ErrCircuitInternal }))
+  assert.Equal(t, Disabled, cb.state)
+  assert.Equal(t, "disabled", cb.CurrentState())
+}
+
+func TestCircuitResetShouldClearFailures(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailuresThreshold(2))
+  cb.Do(func() error { return ErrCircuitInternal })
+  cb.Reset()
+  cb.Do(func() error { return ErrCircuitInternal })
+  assert.Equal(t, Closed, cb.state)
+}
+
+func TestCircuitOpenBackoffShouldMultiplyOpenDuration(t *testing.T) {
+  cb := NewCircuitBreaker("test",
+    WithOpenDuration(time.Hour),
+    WithOpenBackoff(2, 5*time.Hour, 0))
+  assert.Equal(t, time.Hour, cb.OpenDuration())
+
+  cb.openCircuit(Closed, nil)
+  assert.Equal(t, time.Hour, cb.OpenDuration())
+
+  expected := []time.Duration{2 * time.Hour, 4 * time.Hour, 5 * time.Hour, 5 * time.Hour}
+  for _, d := range expected {
+    cb.state = HalfOpen
+    cb.openCircuit(HalfOpen, nil)
+    assert.Equal(t, d, cb.OpenDuration())
+  }
+
+  // once the circuit closes, the backoff starts over
+  cb.state = HalfOpen
+  cb.closeCircuit(HalfOpen)
+  cb.openCircuit(Closed, nil)
+  assert.Equal(t, time.Hour, cb.OpenDuration())
+}
+
+func TestCircuitOpenBackoffShouldApplyJitter(t *testing.T) {
+  cb := NewCircuitBreaker("test",
+    WithOpenDuration(time.Hour),
+    WithOpenBackoff(2, 0, 0.5))
+
+  for i := 0; i < 10; i++ {
+    cb.state = HalfOpen
+    cb.openCircuit(HalfOpen, nil)
+    base := time.Hour * time.Duration(math.Pow(2, float64(i+1)))
+    assert.GreaterOrEqual(t, cb.OpenDuration(), base/2)
+    assert.LessOrEqual(t, cb.OpenDuration(), base+base/2)
+  }
+}
+
+func TestCircuitCloseShouldStopTheBreaker(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  cb := NewCircuitBreaker("test", WithClock(clk), WithFailuresThreshold(1))
+  cb.Do(func() error { return ErrCircuitInternal })
+  assert.Equal(t, 1, clk.Timers())
+
+  cb.Close()
+  cb.Close()
+  assert.Equal(t, 0, clk.Timers(), "the open timer should be canceled")
+  assert.Equal(t, "stopped", cb.CurrentState())
+  assert.Equal(t, ErrCircuitStopped, cb.Do(func() error { return nil }))
+
+  _, err := Execute(cb, func() (int, error) { return 1, nil })
+  assert.Equal(t, ErrCircuitStopped, err)
+
+  // the breaker can't be restarted
+  cb.Reset()
+  cb.ForceClose()
+  assert.Equal(t, Stopped, cb.state)
+}
+
+func TestCircuitCloseShouldNotLeakTimers(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+
+  var numHalfOpen uint32
+  for i := 0; i < 100; i++ {
+    cb := NewCircuitBreaker("test", WithClock(clk), WithFailuresThreshold(1))
+    cb.RegisterOnHalfOpenHooks(func() {
+      atomic.AddUint32(&numHalfOpen, 1)
+    })
+    cb.Do(func() error { return ErrCircuitInternal })
+    cb.Close()
+  }
+
+  assert.Equal(t, 0, clk.Timers())
+  clk.Advance(time.Hour)
+  assert.Equal(t, uint32(0), atomic.LoadUint32(&numHalfOpen), "no open timer should have fired")
+}
+
+func TestCircuitCloseShouldNotLeakGoroutines(t *testing.T) {
+  before := runtime.NumGoroutine()
+
+  for i := 0; i < 100; i++ {
+    opts := []Options{WithFailuresThreshold(1), WithOpenDuration(time.Duration(i%3) * time.Millisecond)}
+    if i%2 == 0 {
+      opts = append(opts, WithAsyncHooks(10))
+    }
+    cb := NewCircuitBreaker("test", opts...)
+    cb.RegisterOnOpenHooks(func() {})
+    cb.RegisterOnHalfOpenHooks(func() {})
+    cb.Do(func() error { return ErrCircuitInternal })
+    if i%4 == 0 {
+      time.Sleep(time.Millisecond)
+    }
+    cb.Close()
+  }
+
+  deadline := time.Now().Add(5 * time.Second)
+  for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+    time.Sleep(10 * time.Millisecond)
+  }
+  assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+// closingClock closes the breaker right before its open timer is armed
+type closingClock struct {
+  *clock.Fake
+  cb *CircuitBreaker
+}
+
+func (c *closingClock) AfterFunc(d time.Duration, f func()) clock.Timer {
+  c.cb.Close()
+  return c.Fake.AfterFunc(d, f)
+}
+
+func TestCircuitCloseShouldStopTimerArmedConcurrently(t *testing.T) {
+  clk := &closingClock{Fake: clock.NewFake(time.Unix(1000, 0))}
+  cb := NewCircuitBreaker("test", WithClock(clk), WithFailuresThreshold(1))
+  clk.cb = cb
+
+  cb.Do(func() error { return ErrCircuitInternal })
+  assert.Equal(t, Stopped, cb.State())
+  assert.Equal(t, 0, clk.Timers())
+}
+
 func BenchmarkDoOpen(b *testing.B) {
   cb := NewCircuitBreaker("test")
   cb.state = Open
@@ -227,6 +752,34 @@ func BenchmarkDoClose(b *testing.B) {
         }
       })
     })
+
+    b.Run(bc.description+" with failure rate window", func(b *testing.B) {
+      cb := NewCircuitBreaker("test", WithFailureRateWindow(100, 10, 101))
+      cb.state = Closed
+
+      op := func() error { return bc.opErr }
+
+      b.ReportAllocs()
+      b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+          cb.Do(op)
+        }
+      })
+    })
+
+    b.Run(bc.description+" with failure rate time window", func(b *testing.B) {
+      cb := NewCircuitBreaker("test", WithFailureRateTimeWindow(10*time.Second, 10, 10, 101))
+      cb.state = Closed
+
+      op := func() error { return bc.opErr }
+
+      b.ReportAllocs()
+      b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+          cb.Do(op)
+        }
+      })
+    })
   }
 
 }
@@ -248,6 +801,6 @@ func BenchmarkOpenCircuit(b *testing.B) {
   cb := NewCircuitBreaker("test")
   for i := 0; i < b.N; i++ {
     cb.state = Closed
-    cb.openCircuit(Closed)
+    cb.openCircuit(Closed, nil)
   }
 }
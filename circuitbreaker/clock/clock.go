@@ -0,0 +1,31 @@
+package clock
+
+import (
+  "time"
+)
+
+// Clock is the source of time of the circuit breaker and its strategies. It can be
+// replaced by a Fake in tests to control the time without waiting for it.
+type Clock interface {
+  Now() time.Time
+  AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+  Stop() bool
+}
+
+type realClock struct{}
+
+// New returns a Clock based on the time package.
+func New() Clock {
+  return realClock{}
+}
+
+func (realClock) Now() time.Time {
+  return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+  return time.AfterFunc(d, f)
+}
@@ -0,0 +1,93 @@
+package clock
+
+import (
+  "sync"
+  "time"
+)
+
+// Fake is a Clock for which the time only moves when Advance is called. The functions
+// given to AfterFunc are called synchronously by Advance once their delay expired.
+type Fake struct {
+  l      sync.Mutex
+  now    time.Time
+  timers []*fakeTimer
+}
+
+type fakeTimer struct {
+  clock *Fake
+  at    time.Time
+  f     func()
+}
+
+func NewFake(now time.Time) *Fake {
+  return &Fake{now: now}
+}
+
+func (c *Fake) Now() time.Time {
+  c.l.Lock()
+  defer c.l.Unlock()
+  return c.now
+}
+
+func (c *Fake) AfterFunc(d time.Duration, f func()) Timer {
+  c.l.Lock()
+  defer c.l.Unlock()
+  t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+  c.timers = append(c.timers, t)
+  return t
+}
+
+// Advance moves the time forward, calling the expired timers in order. A timer
+// created by one of these calls is also called if it expires before the new time.
+func (c *Fake) Advance(d time.Duration) {
+  c.l.Lock()
+  end := c.now.Add(d)
+  for {
+    t := c.next(end)
+    if t == nil {
+      break
+    }
+    c.now = t.at
+    c.remove(t)
+
+    // the lock is released so that the timer function can use the clock
+    c.l.Unlock()
+    t.f()
+    c.l.Lock()
+  }
+  c.now = end
+  c.l.Unlock()
+}
+
+// Timers returns the number of timers that are not expired nor stopped.
+func (c *Fake) Timers() int {
+  c.l.Lock()
+  defer c.l.Unlock()
+  return len(c.timers)
+}
+
+func (c *Fake) next(end time.Time) *fakeTimer {
+  var next *fakeTimer
+  for _, t := range c.timers {
+    if !t.at.After(end) && (next == nil || t.at.Before(next.at)) {
+      next = t
+    }
+  }
+  return next
+}
+
+func (c *Fake) remove(t *fakeTimer) bool {
+  for i := range c.timers {
+    if c.timers[i] == t {
+      c.timers = append(c.timers[:i], c.timers[i+1:]...)
+      return true
+    }
+  }
+  return false
+}
+
+func (t *fakeTimer) Stop() bool {
+  t.clock.l.Lock()
+  defer t.clock.l.Unlock()
+  return t.clock.remove(t)
+}
@@ -0,0 +1,38 @@
+package clock
+
+import (
+  "testing"
+  "time"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestFakeShouldCallExpiredTimersInOrder(t *testing.T) {
+  start := time.Unix(1000, 0)
+  c := NewFake(start)
+
+  var calls []time.Duration
+  c.AfterFunc(2*time.Second, func() {
+    calls = append(calls, c.Now().Sub(start))
+  })
+  c.AfterFunc(time.Second, func() {
+    calls = append(calls, c.Now().Sub(start))
+    // a timer created by a timer function is also called during the same advance
+    c.AfterFunc(500*time.Millisecond, func() {
+      calls = append(calls, c.Now().Sub(start))
+    })
+  })
+  stopped := c.AfterFunc(time.Second, func() {
+    t.Fatal("a stopped timer should not be called")
+  })
+  assert.True(t, stopped.Stop())
+  assert.False(t, stopped.Stop())
+
+  c.Advance(999 * time.Millisecond)
+  assert.Empty(t, calls)
+
+  c.Advance(5 * time.Second)
+  assert.Equal(t, []time.Duration{time.Second, 1500 * time.Millisecond, 2 * time.Second}, calls)
+  assert.Equal(t, start.Add(5999*time.Millisecond), c.Now())
+  assert.Equal(t, 0, c.Timers())
+}
@@ -0,0 +1,106 @@
+package circuitbreaker
+
+import (
+  "sync/atomic"
+  "time"
+)
+
+type Listener = func(event StateChangeEvent)
+
+// StateChangeEvent describes a transition of the circuit from one state to another.
+type StateChangeEvent struct {
+  Name string
+  From State
+  To   State
+  Time time.Time
+  // Err is the error of the call that opened the circuit, ErrSlowCall if the call was
+  // too slow, or nil when the transition was not caused by a call
+  Err                 error
+  ConsecutiveFailures uint32
+  Window              WindowStats
+}
+
+// WindowStats are the counts of the failure rate window at the time of the transition,
+// they are all 0 when the circuit breaker has no failure rate window.
+type WindowStats struct {
+  Calls     uint64
+  Failures  uint64
+  SlowCalls uint64
+  // FailureRate and SlowCallRate are percentages, between 0 and 100
+  FailureRate  float64
+  SlowCallRate float64
+}
+
+func newWindowStats(wc windowCounts) WindowStats {
+  ws := WindowStats{
+    Calls:     wc.calls,
+    Failures:  wc.failures,
+    SlowCalls: wc.slowCalls,
+  }
+  if wc.calls > 0 {
+    ws.FailureRate = float64(wc.failures) * 100 / float64(wc.calls)
+    ws.SlowCallRate = float64(wc.slowCalls) * 100 / float64(wc.calls)
+  }
+  return ws
+}
+
+// RegisterListener registers a function called each time the state of the circuit changes.
+// It can be called concurrently with the calls, and returns a function that removes the listener.
+func (c *CircuitBreaker) RegisterListener(l Listener) (unsubscribe func()) {
+  return c.listeners.add(l)
+}
+
+func (c *CircuitBreaker) RegisterOnOpenHooks(h OnStateChangeHook) (unsubscribe func()) {
+  return c.RegisterListener(onTransitionTo(Open, h))
+}
+
+func (c *CircuitBreaker) RegisterOnCloseHooks(h OnStateChangeHook) (unsubscribe func()) {
+  return c.RegisterListener(onTransitionTo(Closed, h))
+}
+
+func (c *CircuitBreaker) RegisterOnHalfOpenHooks(h OnStateChangeHook) (unsubscribe func()) {
+  return c.RegisterListener(onTransitionTo(HalfOpen, h))
+}
+
+func onTransitionTo(state State, h OnStateChangeHook) Listener {
+  return func(event StateChangeEvent) {
+    if event.To == state {
+      h()
+    }
+  }
+}
+
+// emit records the time at which the circuit entered its new state, and notifies the listeners
+func (c *CircuitBreaker) emit(from, to State, err error) {
+  now := c.clock.Now()
+  atomic.StoreInt64(&c.stateSince, now.UnixNano())
+
+  listeners := c.listeners.load()
+  if len(listeners) == 0 {
+    return
+  }
+
+  event := StateChangeEvent{
+    Name:                c.name,
+    From:                from,
+    To:                  to,
+    Time:                now,
+    Err:                 err,
+    ConsecutiveFailures: atomic.LoadUint32(&c.consecutiveFailures),
+  }
+  if c.window != nil {
+    event.Window = newWindowStats(c.window.counts())
+  }
+
+  if c.hookQueue != nil {
+    c.hookQueue.dispatch(func() { runListeners(listeners, event) })
+    return
+  }
+  runListeners(listeners, event)
+}
+
+func runListeners(listeners []*Listener, event StateChangeEvent) {
+  for _, l := range listeners {
+    (*l)(event)
+  }
+}
@@ -0,0 +1,116 @@
+package circuitbreaker
+
+import (
+  "errors"
+  "testing"
+  "time"
+
+  "github.com/ocampeau/gutils/circuitbreaker/clock"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestListenerShouldReceiveTheTransitions(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  cb := NewCircuitBreaker("test",
+    WithClock(clk),
+    WithFailureRateWindow(4, 4, 50),
+    WithOpenDuration(3*time.Second),
+    WithTimerStrategy(time.Second, 1))
+
+  var events []StateChangeEvent
+  cb.RegisterListener(func(event StateChangeEvent) {
+    events = append(events, event)
+  })
+
+  errOp := errors.New("operation error")
+  cb.Do(func() error { return nil })
+  cb.Do(func() error { return errOp })
+  cb.Do(func() error { return nil })
+  cb.Do(func() error { return errOp })
+
+  if assert.Len(t, events, 1) {
+    assert.Equal(t, StateChangeEvent{
+      Name: "test",
+      From: Closed,
+      To:   Open,
+      Time: time.Unix(1000, 0),
+      Err:  errOp,
+      // the consecutive failures are counted even with a failure rate window
+      ConsecutiveFailures: 1,
+      Window: WindowStats{
+        Calls:       4,
+        Failures:    2,
+        FailureRate: 50,
+      },
+    }, events[0])
+  }
+
+  clk.Advance(3 * time.Second)
+  cb.Do(func() error { return nil })
+
+  if assert.Len(t, events, 3) {
+    assert.Equal(t, Open, events[1].From)
+    assert.Equal(t, HalfOpen, events[1].To)
+    assert.Equal(t, time.Unix(1003, 0), events[1].Time)
+    assert.Nil(t, events[1].Err)
+
+    assert.Equal(t, HalfOpen, events[2].From)
+    assert.Equal(t, Closed, events[2].To)
+    assert.Equal(t, WindowStats{}, events[2].Window, "the window should be reset when the circuit closes")
+  }
+}
+
+func TestListenerShouldReceiveTheConsecutiveFailures(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailuresThreshold(3))
+
+  var event StateChangeEvent
+  cb.RegisterListener(func(e StateChangeEvent) {
+    event = e
+  })
+
+  for i := 0; i < 3; i++ {
+    cb.Do(func() error { return ErrCircuitInternal })
+  }
+  assert.Equal(t, Open, event.To)
+  assert.Equal(t, uint32(3), event.ConsecutiveFailures)
+  assert.Equal(t, ErrCircuitInternal, event.Err)
+}
+
+func TestListenerShouldReceiveSlowCallAsError(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  cb := NewCircuitBreaker("test", WithClock(clk), WithFailuresThreshold(1), WithSlowCallThreshold(time.Second))
+
+  var event StateChangeEvent
+  cb.RegisterListener(func(e StateChangeEvent) {
+    event = e
+  })
+
+  cb.Do(slowOp(clk, 2*time.Second))
+  assert.Equal(t, Open, event.To)
+  assert.Equal(t, ErrSlowCall, event.Err)
+}
+
+func TestListenerShouldReceiveManualTransitions(t *testing.T) {
+  cb := NewCircuitBreaker("test")
+
+  var events []StateChangeEvent
+  cb.RegisterListener(func(event StateChangeEvent) {
+    events = append(events, event)
+  })
+  var numClose int
+  cb.RegisterOnCloseHooks(func() {
+    numClose++
+  })
+
+  cb.ForceOpen()
+  cb.ForceOpen()
+  cb.Reset()
+  cb.Close()
+
+  if assert.Len(t, events, 3) {
+    assert.Equal(t, [2]State{Closed, ForcedOpen}, [2]State{events[0].From, events[0].To})
+    assert.Equal(t, [2]State{ForcedOpen, Closed}, [2]State{events[1].From, events[1].To})
+    assert.Equal(t, [2]State{Closed, Stopped}, [2]State{events[2].From, events[2].To})
+  }
+  assert.Equal(t, 1, numClose)
+}
@@ -38,6 +38,15 @@ func someComplexOperation(a, b, c int) (int, error) {
   return a + b*c, nil
 }
 
+// with the generic `Execute` function, there is no need
+// for a closure to get the result of the operation
+func executeOperation(cb *circuitbreaker.CircuitBreaker) (int, error) {
+  return circuitbreaker.Execute(cb, func() (int, error) {
+    return someComplexOperation(1, 2, 3)
+  })
+}
+
 func init() {
   createCircuitBreaker()
+  executeOperation(circuitbreaker.NewCircuitBreaker("myCircuitBreaker"))
 }
@@ -0,0 +1,105 @@
+package circuitbreaker
+
+import (
+  "context"
+  "errors"
+
+  "github.com/ocampeau/gutils/circuitbreaker/strategy"
+)
+
+// Execute calls `fn` through the circuit breaker and returns its result, which avoids
+// capturing the result in a closure given to Do.
+func Execute[T any](cb *CircuitBreaker, fn func() (T, error)) (T, error) {
+  ctx := context.Background()
+  res, err := execute(ctx, cb, fn)
+  return res, cb.fallbackFor(ctx, err)
+}
+
+// ExecuteContext is the generic counterpart of DoContext.
+func ExecuteContext[T any](ctx context.Context, cb *CircuitBreaker, fn func(ctx context.Context) (T, error)) (res T, err error) {
+  if err = cb.contextDone(ctx); err != nil {
+    return
+  }
+  if cb.loadState() == Closed {
+    start := cb.startCall()
+    res, err = callContext(ctx, cb, fn)
+    cb.recordClose(ctx, err, cb.isSlow(start))
+  } else {
+    res, err = executeNotClosed(ctx, cb, func() (T, error) {
+      return fn(ctx)
+    })
+  }
+  cb.rethrow(err)
+  return res, cb.fallbackFor(ctx, err)
+}
+
+// ExecuteWithFallback is like Execute, but returns `fallback` instead of an error when the
+// circuit rejects the call, or when the call fails if the breaker was created with
+// WithFallbackOnFailure.
+func ExecuteWithFallback[T any](cb *CircuitBreaker, fn func() (T, error), fallback T) (T, error) {
+  ctx := context.Background()
+  res, err := execute(ctx, cb, fn)
+  if cb.shouldFallback(ctx, err) {
+    cb.execFallbackHooks(err)
+    return fallback, nil
+  }
+  return res, err
+}
+
+// ExecuteWithFallbackFunc is the generic counterpart of WithFallback: `fallback` is called
+// with the original error in the same conditions, and replaces the fallback of the breaker
+// for this call.
+func ExecuteWithFallbackFunc[T any](cb *CircuitBreaker, fn func() (T, error), fallback func(err error) (T, error)) (T, error) {
+  ctx := context.Background()
+  res, err := execute(ctx, cb, fn)
+  if cb.shouldFallback(ctx, err) {
+    cb.execFallbackHooks(err)
+    return fallback(err)
+  }
+  return res, err
+}
+
+func execute[T any](ctx context.Context, cb *CircuitBreaker, fn func() (T, error)) (res T, err error) {
+  // in the closed state, the function is called directly to avoid allocating a closure
+  if cb.loadState() == Closed {
+    start := cb.startCall()
+    res, err = call(cb, fn)
+    cb.recordClose(ctx, err, cb.isSlow(start))
+  } else {
+    res, err = executeNotClosed(ctx, cb, fn)
+  }
+  cb.rethrow(err)
+  return
+}
+
+func call[T any](cb *CircuitBreaker, fn func() (T, error)) (res T, err error) {
+  if cb.recoverPanics {
+    defer cb.recoverPanic(&err)
+  }
+  return fn()
+}
+
+func callContext[T any](ctx context.Context, cb *CircuitBreaker, fn func(ctx context.Context) (T, error)) (res T, err error) {
+  if cb.recoverPanics {
+    defer cb.recoverPanic(&err)
+  }
+  return fn(ctx)
+}
+
+// executeNotClosed is kept apart so that the result captured by the closure only escapes
+// to the heap when the circuit is not closed
+func executeNotClosed[T any](ctx context.Context, cb *CircuitBreaker, fn func() (T, error)) (res T, err error) {
+  err = cb.dispatch(ctx, func() (opErr error) {
+    res, opErr = fn()
+    return
+  })
+  return
+}
+
+// IsRejection tells if the error means that the operation was not called because of the
+// state of the circuit: open, half-open with no probe allowed, or stopped.
+func IsRejection(err error) bool {
+  return err != nil && (errors.Is(err, ErrCircuitOpen) ||
+    errors.Is(err, strategy.ErrHalfOpen) ||
+    errors.Is(err, ErrCircuitStopped))
+}
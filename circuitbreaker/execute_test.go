@@ -0,0 +1,138 @@
+package circuitbreaker
+
+import (
+  "context"
+  "errors"
+  "testing"
+
+  "github.com/ocampeau/gutils/circuitbreaker/strategy"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestExecuteShouldReturnTheResult(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailuresThreshold(1))
+
+  res, err := Execute(cb, func() (int, error) { return 42, nil })
+  assert.Nil(t, err)
+  assert.Equal(t, 42, res)
+
+  errOp := errors.New("operation error")
+  res, err = Execute(cb, func() (int, error) { return 0, errOp })
+  assert.Equal(t, errOp, err)
+  assert.Equal(t, Open, cb.state)
+
+  res, err = Execute(cb, func() (int, error) { return 42, nil })
+  assert.Equal(t, ErrCircuitOpen, err)
+  assert.Equal(t, 0, res)
+}
+
+func TestExecuteContextShouldGiveTheContext(t *testing.T) {
+  type key struct{}
+  cb := NewCircuitBreaker("test")
+  ctx := context.WithValue(context.Background(), key{}, "value")
+
+  res, err := ExecuteContext(ctx, cb, func(ctx context.Context) (string, error) {
+    return ctx.Value(key{}).(string), nil
+  })
+  assert.Nil(t, err)
+  assert.Equal(t, "value", res)
+
+  ctx, cancel := context.WithCancel(ctx)
+  cancel()
+  _, err = ExecuteContext(ctx, cb, func(ctx context.Context) (string, error) {
+    t.Fatal("the function should not be called when the context is done")
+    return "", nil
+  })
+  assert.Equal(t, context.Canceled, err)
+}
+
+func TestExecuteWithFallbackShouldReturnFallbackOnRejection(t *testing.T) {
+  fn := func() (string, error) { return "value", nil }
+
+  cb := NewCircuitBreaker("test")
+  cb.state = Open
+  res, err := ExecuteWithFallback(cb, fn, "fallback")
+  assert.Nil(t, err)
+  assert.Equal(t, "fallback", res)
+
+  cb = NewCircuitBreaker("test", WithCustomStrategy(strategy.NewTimerStrategy(0, 1)))
+  cb.state = HalfOpen
+  res, err = ExecuteWithFallback(cb, fn, "fallback")
+  assert.Nil(t, err)
+  assert.Equal(t, "value", res)
+}
+
+func TestExecuteWithFallbackFuncShouldReceiveTheRejection(t *testing.T) {
+  var numHooks int
+  cb := NewCircuitBreaker("test")
+  cb.RegisterOnFallbackHooks(func(err error) {
+    numHooks++
+  })
+  cb.state = Open
+
+  res, err := ExecuteWithFallbackFunc(cb, func() (string, error) {
+    return "value", nil
+  }, func(err error) (string, error) {
+    return "fallback: " + err.Error(), nil
+  })
+  assert.Nil(t, err)
+  assert.Equal(t, "fallback: "+ErrCircuitOpen.Error(), res)
+  assert.Equal(t, 1, numHooks)
+}
+
+func TestExecuteShouldUseTheBreakerFallback(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFallback(func(err error) error {
+    return nil
+  }))
+  cb.state = Open
+
+  res, err := Execute(cb, func() (int, error) { return 1, nil })
+  assert.Nil(t, err)
+  assert.Equal(t, 0, res)
+}
+
+func BenchmarkExecuteClose(b *testing.B) {
+  cb := NewCircuitBreaker("test")
+  fn := func() (int, error) { return 1, nil }
+
+  b.ReportAllocs()
+  b.RunParallel(func(pb *testing.PB) {
+    for pb.Next() {
+      Execute(cb, fn)
+    }
+  })
+}
+
+func BenchmarkExecuteContextClose(b *testing.B) {
+  cb := NewCircuitBreaker("test")
+  ctx := context.Background()
+  fn := func(ctx context.Context) (int, error) { return 1, nil }
+
+  b.ReportAllocs()
+  b.RunParallel(func(pb *testing.PB) {
+    for pb.Next() {
+      ExecuteContext(ctx, cb, fn)
+    }
+  })
+}
+
+func TestIsRejection(t *testing.T) {
+  assert.True(t, IsRejection(ErrCircuitOpen))
+  assert.True(t, IsRejection(strategy.ErrHalfOpen))
+  assert.True(t, IsRejection(ErrCircuitStopped))
+  assert.True(t, IsRejection(&rejectionError{rejection: ErrCircuitOpen, err: context.Canceled}))
+  assert.False(t, IsRejection(nil))
+  assert.False(t, IsRejection(ErrCircuitInternal))
+}
+
+func TestFallbackShouldReplaceTheRejectionOfAStoppedBreaker(t *testing.T) {
+  var rejection error
+  cb := NewCircuitBreaker("test", WithFallback(func(err error) error {
+    rejection = err
+    return nil
+  }))
+  cb.Close()
+
+  assert.Nil(t, cb.Do(func() error { return nil }))
+  assert.Equal(t, ErrCircuitStopped, rejection)
+}
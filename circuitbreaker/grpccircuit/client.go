@@ -0,0 +1,98 @@
+package grpccircuit
+
+import (
+  "context"
+  "io"
+  "sync"
+
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/status"
+)
+
+// UnaryClientInterceptor calls the RPCs through the circuit breakers. The RPCs rejected
+// by a circuit breaker fail with the Unavailable code.
+func (i *Interceptor) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+  return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+    err := i.Breakers.DoContext(ctx, i.key(cc.Target(), method), func(ctx context.Context) error {
+      return invoker(ctx, method, req, reply, cc, opts...)
+    })
+    return toStatusError(err)
+  }
+}
+
+// StreamClientInterceptor opens the streams through the circuit breakers. The outcome of
+// a stream is recorded when it ends, with the error returned by RecvMsg (or the error of its
+// context, if it is done first), and its circuit breaker is not closed by an eviction until then. Opening a stream is not counted, so
+// while half-open the circuit closes or opens again on the outcome of the streams.
+func (i *Interceptor) StreamClientInterceptor() grpc.StreamClientInterceptor {
+  return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+    cb, release := i.Breakers.Acquire(i.key(cc.Target(), method))
+
+    var stream grpc.ClientStream
+    done, err := cb.DoDeferred(ctx, func(ctx context.Context) error {
+      var err error
+      stream, err = streamer(ctx, desc, cc, method, opts...)
+      return err
+    })
+    if err != nil {
+      release()
+      return nil, toStatusError(err)
+    }
+    s := &clientStream{ClientStream: stream, desc: desc, done: done, release: release, ended: make(chan struct{})}
+    if ctx.Done() != nil {
+      go s.watch(ctx)
+    }
+    return s, nil
+  }
+}
+
+// clientStream records the outcome of the stream once it ends
+type clientStream struct {
+  grpc.ClientStream
+  desc    *grpc.StreamDesc
+  done    func(err error)
+  release func()
+  once    sync.Once
+  ended   chan struct{}
+}
+
+func (s *clientStream) RecvMsg(m interface{}) error {
+  err := s.ClientStream.RecvMsg(m)
+  switch {
+  case err == io.EOF:
+    s.end(nil)
+  case err != nil:
+    s.end(err)
+  case !s.desc.ServerStreams:
+    // the server sends a single message, so the stream ends once it is received
+    s.end(nil)
+  }
+  return err
+}
+
+func (s *clientStream) SendMsg(m interface{}) error {
+  err := s.ClientStream.SendMsg(m)
+  // io.EOF means that the stream ended, its status is returned by RecvMsg
+  if err != nil && err != io.EOF {
+    s.end(err)
+  }
+  return err
+}
+
+// watch ends the stream once its context is done, since the caller may abandon
+// a canceled stream without calling RecvMsg again
+func (s *clientStream) watch(ctx context.Context) {
+  select {
+  case <-ctx.Done():
+    s.end(status.FromContextError(ctx.Err()).Err())
+  case <-s.ended:
+  }
+}
+
+func (s *clientStream) end(err error) {
+  s.once.Do(func() {
+    s.done(err)
+    s.release()
+    close(s.ended)
+  })
+}
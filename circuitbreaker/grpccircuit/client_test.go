@@ -0,0 +1,315 @@
+package grpccircuit
+
+import (
+  "context"
+  "io"
+  "net"
+  "strings"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/ocampeau/gutils/circuitbreaker"
+  "github.com/ocampeau/gutils/circuitbreaker/clock"
+  "github.com/prometheus/client_golang/prometheus/testutil"
+  "github.com/stretchr/testify/assert"
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/credentials/insecure"
+  "google.golang.org/grpc/health/grpc_health_v1"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/test/bufconn"
+)
+
+// healthServer answers the Check and Watch RPCs with the code stored in `code`
+type healthServer struct {
+  grpc_health_v1.UnimplementedHealthServer
+  code  uint32
+  calls uint32
+}
+
+func (s *healthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+  atomic.AddUint32(&s.calls, 1)
+  if code := codes.Code(atomic.LoadUint32(&s.code)); code != codes.OK {
+    return nil, status.Error(code, "check failed")
+  }
+  return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+func (s *healthServer) Watch(req *grpc_health_v1.HealthCheckRequest, stream grpc_health_v1.Health_WatchServer) error {
+  atomic.AddUint32(&s.calls, 1)
+  if code := codes.Code(atomic.LoadUint32(&s.code)); code != codes.OK {
+    return status.Error(code, "watch failed")
+  }
+  return stream.Send(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING})
+}
+
+// upload receives the messages of a client-streaming RPC and answers once the client closes it
+func (s *healthServer) upload(stream grpc.ServerStream) error {
+  atomic.AddUint32(&s.calls, 1)
+  for {
+    if err := stream.RecvMsg(&grpc_health_v1.HealthCheckRequest{}); err == io.EOF {
+      break
+    } else if err != nil {
+      return err
+    }
+  }
+  if code := codes.Code(atomic.LoadUint32(&s.code)); code != codes.OK {
+    return status.Error(code, "upload failed")
+  }
+  return stream.SendMsg(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING})
+}
+
+// uploadDesc describes a client-streaming RPC, the health service has none
+var uploadDesc = grpc.StreamDesc{
+  StreamName:    "Upload",
+  ClientStreams: true,
+  Handler: func(srv interface{}, stream grpc.ServerStream) error {
+    return srv.(*healthServer).upload(stream)
+  },
+}
+
+func (s *healthServer) setCode(code codes.Code) {
+  atomic.StoreUint32(&s.code, uint32(code))
+}
+
+// startServer starts an in-process server and returns a connection to it, made with `target`
+func startServer(t *testing.T, target string, srv *healthServer, serverOpts []grpc.ServerOption, dialOpts ...grpc.DialOption) *grpc.ClientConn {
+  lis := bufconn.Listen(1024 * 1024)
+  s := grpc.NewServer(serverOpts...)
+  grpc_health_v1.RegisterHealthServer(s, srv)
+  s.RegisterService(&grpc.ServiceDesc{
+    ServiceName: "test.Upload",
+    HandlerType: (*interface{})(nil),
+    Streams:     []grpc.StreamDesc{uploadDesc},
+  }, srv)
+  go s.Serve(lis)
+  t.Cleanup(s.Stop)
+
+  dialOpts = append(dialOpts,
+    grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+      return lis.DialContext(ctx)
+    }),
+    grpc.WithTransportCredentials(insecure.NewCredentials()))
+  conn, err := grpc.Dial(target, dialOpts...)
+  assert.NoError(t, err)
+  t.Cleanup(func() { conn.Close() })
+  return conn
+}
+
+func check(conn *grpc.ClientConn) error {
+  _, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+  return err
+}
+
+func watch(conn *grpc.ClientConn) error {
+  stream, err := grpc_health_v1.NewHealthClient(conn).Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+  if err != nil {
+    return err
+  }
+  for {
+    if _, err := stream.Recv(); err == io.EOF {
+      return nil
+    } else if err != nil {
+      return err
+    }
+  }
+}
+
+// upload sends `n` messages on a client-streaming RPC and waits for the answer
+func upload(conn *grpc.ClientConn, n int) error {
+  stream, err := conn.NewStream(context.Background(), &uploadDesc, "/test.Upload/Upload")
+  if err != nil {
+    return err
+  }
+  for j := 0; j < n; j++ {
+    if err := stream.SendMsg(&grpc_health_v1.HealthCheckRequest{}); err != nil {
+      break
+    }
+  }
+  if err := stream.CloseSend(); err != nil {
+    return err
+  }
+  return stream.RecvMsg(&grpc_health_v1.HealthCheckResponse{})
+}
+
+func TestUnaryClientInterceptorShouldOpenOnUnavailable(t *testing.T) {
+  for _, code := range []codes.Code{codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted} {
+    i := NewInterceptor("health", WithBreakerOptions(circuitbreaker.WithFailuresThreshold(2)))
+    srv := &healthServer{code: uint32(code)}
+    conn := startServer(t, "bufnet", srv, nil, grpc.WithUnaryInterceptor(i.UnaryClientInterceptor()))
+
+    assert.Equal(t, code, status.Code(check(conn)))
+    assert.Equal(t, code, status.Code(check(conn)))
+
+    err := check(conn)
+    assert.Equal(t, codes.Unavailable, status.Code(err), "a rejection should be an Unavailable status")
+    assert.Contains(t, status.Convert(err).Message(), circuitbreaker.ErrCircuitOpen.Error())
+    assert.Equal(t, uint32(2), atomic.LoadUint32(&srv.calls), "code %s should open the circuit", code)
+    i.Close()
+  }
+}
+
+func TestUnaryClientInterceptorShouldCountClientErrorsAsSuccesses(t *testing.T) {
+  for _, code := range []codes.Code{codes.InvalidArgument, codes.NotFound} {
+    i := NewInterceptor("health", WithBreakerOptions(circuitbreaker.WithFailuresThreshold(1)))
+    conn := startServer(t, "bufnet", &healthServer{code: uint32(code)}, nil, grpc.WithUnaryInterceptor(i.UnaryClientInterceptor()))
+
+    for j := 0; j < 3; j++ {
+      assert.Equal(t, code, status.Code(check(conn)))
+    }
+    assert.Equal(t, circuitbreaker.Closed, i.Breakers.Get("/grpc.health.v1.Health/Check").State())
+    i.Close()
+  }
+}
+
+func TestClientInterceptorShouldUseOneBreakerPerTarget(t *testing.T) {
+  i := NewInterceptor("health", WithKey(TargetKey), WithBreakerOptions(circuitbreaker.WithFailuresThreshold(1)))
+  defer i.Close()
+  col := NewPromCollector(i)
+
+  down := startServer(t, "down", &healthServer{code: uint32(codes.Unavailable)}, nil, grpc.WithUnaryInterceptor(i.UnaryClientInterceptor()))
+  up := startServer(t, "up", &healthServer{}, nil, grpc.WithUnaryInterceptor(i.UnaryClientInterceptor()))
+
+  check(down)
+  assert.Equal(t, codes.Unavailable, status.Code(check(down)))
+  assert.Equal(t, circuitbreaker.Open, i.Breakers.Get("down").State())
+  assert.NoError(t, check(up))
+
+  expected := `
+# HELP circuit_breaker_open_state A counter indicating the number of times the circuit has been in the open state
+# TYPE circuit_breaker_open_state counter
+circuit_breaker_open_state{circuit_breaker_key="down",circuit_breaker_name="health"} 1
+circuit_breaker_open_state{circuit_breaker_key="up",circuit_breaker_name="health"} 0
+`
+  assert.Nil(t, testutil.CollectAndCompare(col, strings.NewReader(expected), "circuit_breaker_open_state"))
+}
+
+func TestStreamClientInterceptorShouldRecordTheOutcomeOfTheStream(t *testing.T) {
+  i := NewInterceptor("health", WithBreakerOptions(circuitbreaker.WithFailuresThreshold(2)))
+  defer i.Close()
+  srv := &healthServer{}
+  conn := startServer(t, "bufnet", srv, nil, grpc.WithStreamInterceptor(i.StreamClientInterceptor()))
+  cb := i.Breakers.Get("/grpc.health.v1.Health/Watch")
+
+  // a stream ending normally is a success
+  assert.Equal(t, codes.OK, status.Code(watch(conn)))
+  assert.Equal(t, uint64(1), cb.Stats().Successes)
+
+  srv.setCode(codes.Unavailable)
+  assert.Equal(t, codes.Unavailable, status.Code(watch(conn)))
+  assert.Equal(t, codes.Unavailable, status.Code(watch(conn)))
+  assert.Equal(t, circuitbreaker.Open, cb.State())
+
+  err := watch(conn)
+  assert.Equal(t, codes.Unavailable, status.Code(err))
+  assert.Contains(t, status.Convert(err).Message(), circuitbreaker.ErrCircuitOpen.Error())
+  assert.Equal(t, uint32(3), atomic.LoadUint32(&srv.calls))
+}
+
+func TestStreamClientInterceptorShouldNotReturnANilStreamWhenAFallbackReplacesTheRejection(t *testing.T) {
+  i := NewInterceptor("health", WithBreakerOptions(circuitbreaker.WithFallback(func(err error) error { return nil })))
+  defer i.Close()
+  conn := startServer(t, "bufnet", &healthServer{}, nil, grpc.WithStreamInterceptor(i.StreamClientInterceptor()))
+  i.Breakers.Get("/grpc.health.v1.Health/Watch").ForceOpen()
+
+  assert.Equal(t, codes.Unavailable, status.Code(watch(conn)))
+}
+
+func TestStreamClientInterceptorHalfOpenShouldCountTheOutcomeOfTheStreams(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  i := NewInterceptor("health", WithBreakerOptions(
+    circuitbreaker.WithClock(clk),
+    circuitbreaker.WithFailuresThreshold(1),
+    circuitbreaker.WithOpenDuration(time.Second),
+    circuitbreaker.WithTimerStrategy(time.Second, 2)))
+  defer i.Close()
+  srv := &healthServer{code: uint32(codes.Unavailable)}
+  conn := startServer(t, "bufnet", srv, nil, grpc.WithStreamInterceptor(i.StreamClientInterceptor()))
+  cb := i.Breakers.Get("/grpc.health.v1.Health/Watch")
+
+  watch(conn)
+  clk.Advance(time.Second)
+  assert.Equal(t, circuitbreaker.HalfOpen, cb.State())
+
+  // the open stream is the probe, the other streams are rejected until it ends
+  srv.setCode(codes.OK)
+  stream, err := grpc_health_v1.NewHealthClient(conn).Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+  assert.NoError(t, err)
+  assert.Equal(t, codes.Unavailable, status.Code(watch(conn)))
+  assert.Equal(t, circuitbreaker.HalfOpen, cb.State())
+
+  for err := error(nil); err == nil; _, err = stream.Recv() {
+  }
+  assert.Equal(t, circuitbreaker.HalfOpen, cb.State())
+  clk.Advance(time.Second)
+  assert.NoError(t, watch(conn))
+  assert.Equal(t, circuitbreaker.Closed, cb.State())
+
+  // a failing stream opens the circuit again
+  srv.setCode(codes.Unavailable)
+  watch(conn)
+  clk.Advance(time.Second)
+  assert.Equal(t, circuitbreaker.HalfOpen, cb.State())
+  assert.Equal(t, codes.Unavailable, status.Code(watch(conn)))
+  assert.Equal(t, circuitbreaker.Open, cb.State())
+}
+
+func TestStreamClientInterceptorShouldRecordTheOutcomeOfClientStreams(t *testing.T) {
+  i := NewInterceptor("upload", WithBreakerOptions(circuitbreaker.WithFailuresThreshold(2)))
+  defer i.Close()
+  srv := &healthServer{}
+  conn := startServer(t, "bufnet", srv, nil, grpc.WithStreamInterceptor(i.StreamClientInterceptor()))
+  cb := i.Breakers.Get("/test.Upload/Upload")
+
+  // the stream ends with the answer of the server, the caller does not read until io.EOF
+  for j := 0; j < 3; j++ {
+    assert.NoError(t, upload(conn, 3))
+  }
+  assert.Equal(t, uint64(3), cb.Stats().Successes)
+
+  srv.setCode(codes.Unavailable)
+  assert.Equal(t, codes.Unavailable, status.Code(upload(conn, 1)))
+  assert.Equal(t, codes.Unavailable, status.Code(upload(conn, 1)))
+  assert.Equal(t, circuitbreaker.Open, cb.State())
+  assert.Equal(t, uint32(5), atomic.LoadUint32(&srv.calls))
+}
+
+func TestStreamClientInterceptorHalfOpenShouldReleaseTheProbeOfACanceledStream(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  i := NewInterceptor("health", WithBreakerOptions(
+    circuitbreaker.WithClock(clk),
+    circuitbreaker.WithFailuresThreshold(1),
+    circuitbreaker.WithOpenDuration(time.Second),
+    circuitbreaker.WithTimerStrategy(time.Second, 1)))
+  defer i.Close()
+  srv := &healthServer{code: uint32(codes.Unavailable)}
+  conn := startServer(t, "bufnet", srv, nil, grpc.WithStreamInterceptor(i.StreamClientInterceptor()))
+  cb := i.Breakers.Get("/grpc.health.v1.Health/Watch")
+
+  watch(conn)
+  clk.Advance(time.Second)
+  assert.Equal(t, circuitbreaker.HalfOpen, cb.State())
+
+  // the probe is abandoned after its context is canceled, without reading it again
+  srv.setCode(codes.OK)
+  ctx, cancel := context.WithCancel(context.Background())
+  _, err := grpc_health_v1.NewHealthClient(conn).Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+  assert.NoError(t, err)
+  assert.Equal(t, codes.Unavailable, status.Code(watch(conn)))
+  cancel()
+
+  assert.Eventually(t, func() bool { return watch(conn) == nil }, time.Second, time.Millisecond)
+  assert.Equal(t, circuitbreaker.Closed, cb.State())
+}
+
+func TestUnaryClientInterceptorShouldReturnTheContextError(t *testing.T) {
+  i := NewInterceptor("health")
+  defer i.Close()
+  conn := startServer(t, "bufnet", &healthServer{}, nil, grpc.WithUnaryInterceptor(i.UnaryClientInterceptor()))
+
+  ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+  defer cancel()
+  _, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+  assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
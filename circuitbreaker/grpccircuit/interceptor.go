@@ -0,0 +1,183 @@
+// Package grpccircuit provides gRPC interceptors calling the RPCs through circuit breakers.
+package grpccircuit
+
+import (
+  "context"
+  "errors"
+  "time"
+
+  "github.com/ocampeau/gutils/circuitbreaker"
+  "github.com/ocampeau/gutils/circuitbreaker/strategy"
+  "github.com/prometheus/client_golang/prometheus"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+)
+
+type Options func(i *Interceptor)
+
+// KeyFunc returns the key of the circuit breaker of an RPC, from the target of the
+// connection and the full method name of the RPC.
+type KeyFunc = func(target, method string) string
+
+// CodeClassifier returns true when the status code of an RPC is a failure.
+type CodeClassifier = func(code codes.Code) bool
+
+// Interceptor creates the gRPC interceptors. Each key (the method by default) gets its
+// own circuit breaker, kept in a KeyedCircuitBreaker.
+type Interceptor struct {
+  Breakers        *circuitbreaker.KeyedCircuitBreaker
+  key             KeyFunc
+  isFailure       CodeClassifier
+  isServerFailure CodeClassifier
+  breakerOpts     []circuitbreaker.Options
+  maxKeys     int
+  keyTTL      time.Duration
+}
+
+// NewInterceptor creates an Interceptor whose circuit breakers are named `name/key`. The circuit
+// breakers count the errors with the CodeClassifier, so they must not be given WithFailurePredicate.
+func NewInterceptor(name string, opts ...Options) *Interceptor {
+  i := Interceptor{
+    key:             MethodKey,
+    isFailure:       DefaultCodeClassifier,
+    isServerFailure: DefaultServerCodeClassifier,
+  }
+  for _, apply := range opts {
+    apply(&i)
+  }
+
+  breakerOpts := append([]circuitbreaker.Options{circuitbreaker.WithFailurePredicate(i.countsAsFailure)}, i.breakerOpts...)
+  i.Breakers = circuitbreaker.NewKeyedCircuitBreaker(name, i.maxKeys, i.keyTTL, breakerOpts...)
+  return &i
+}
+
+// Close closes all the circuit breakers of the interceptor.
+func (i *Interceptor) Close() {
+  i.Breakers.Close()
+}
+
+// NewPromCollector exports the metrics of the circuit breakers of the interceptor,
+// with their key as a label.
+func NewPromCollector(i *Interceptor) prometheus.Collector {
+  return circuitbreaker.NewKeyedPromCollector(i.Breakers)
+}
+
+// MethodKey gives a circuit breaker to each method.
+func MethodKey(_, method string) string {
+  return method
+}
+
+// TargetKey gives a circuit breaker to each target, for all its methods.
+func TargetKey(target, _ string) string {
+  return target
+}
+
+// DefaultCodeClassifier counts the Unavailable, DeadlineExceeded and ResourceExhausted
+// codes as failures. The other codes, like InvalidArgument or NotFound, are successes
+// since the server handled the RPC.
+func DefaultCodeClassifier(code codes.Code) bool {
+  switch code {
+  case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+    return true
+  }
+  return false
+}
+
+// DefaultServerCodeClassifier counts the Unknown, Internal and Unavailable codes as failures,
+// which are the codes of a handler failing because of its dependencies: an error that is not
+// a status, like a database error, has the Unknown code.
+func DefaultServerCodeClassifier(code codes.Code) bool {
+  switch code {
+  case codes.Unknown, codes.Internal, codes.Unavailable:
+    return true
+  }
+  return false
+}
+
+func (i *Interceptor) countsAsFailure(err error) bool {
+  var handlerErr *handlerError
+  if errors.As(err, &handlerErr) {
+    return i.isServerFailure(status.Code(handlerErr.err))
+  }
+  return i.isFailure(status.Code(err))
+}
+
+// handlerError is the error of a server handler, seen by the circuit breaker. It matches
+// strategy.ErrIgnored when the handler failed because the deadline of the client is exceeded,
+// so that it is not counted.
+type handlerError struct {
+  err            error
+  callerDeadline bool
+}
+
+func newHandlerError(ctx context.Context, err error) error {
+  if err == nil {
+    return nil
+  }
+  callerDeadline := ctx.Err() == context.DeadlineExceeded && status.Code(toStatusError(err)) == codes.DeadlineExceeded
+  return &handlerError{err: err, callerDeadline: callerDeadline}
+}
+
+func (e *handlerError) Error() string {
+  return e.err.Error()
+}
+
+func (e *handlerError) Is(target error) bool {
+  return e.callerDeadline && target == strategy.ErrIgnored
+}
+
+func (e *handlerError) Unwrap() error {
+  return e.err
+}
+
+// toStatusError converts the errors of the circuit breaker into gRPC status errors
+func toStatusError(err error) error {
+  if err == nil {
+    return nil
+  }
+  var handlerErr *handlerError
+  if errors.As(err, &handlerErr) {
+    err = handlerErr.err
+  }
+  if _, ok := status.FromError(err); ok {
+    return err
+  }
+  if circuitbreaker.IsRejection(err) {
+    return status.Error(codes.Unavailable, err.Error())
+  }
+  if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+    return status.FromContextError(err).Err()
+  }
+  return err
+}
+
+// WithBreakerOptions gives options to the circuit breakers of the interceptor.
+func WithBreakerOptions(opts ...circuitbreaker.Options) func(i *Interceptor) {
+  return func(i *Interceptor) {
+    i.breakerOpts = append(i.breakerOpts, opts...)
+  }
+}
+
+// WithKey replaces MethodKey to decide which RPCs share a circuit breaker, for example TargetKey.
+func WithKey(key KeyFunc) func(i *Interceptor) {
+  return func(i *Interceptor) {
+    i.key = key
+  }
+}
+
+// WithCodeClassifier replaces DefaultCodeClassifier and DefaultServerCodeClassifier to decide
+// which status codes are failures.
+func WithCodeClassifier(isFailure CodeClassifier) func(i *Interceptor) {
+  return func(i *Interceptor) {
+    i.isFailure = isFailure
+    i.isServerFailure = isFailure
+  }
+}
+
+// WithMaxKeys bounds the number of circuit breakers kept by the interceptor, see NewKeyedCircuitBreaker.
+func WithMaxKeys(maxKeys int, ttl time.Duration) func(i *Interceptor) {
+  return func(i *Interceptor) {
+    i.maxKeys = maxKeys
+    i.keyTTL = ttl
+  }
+}
@@ -0,0 +1,37 @@
+package grpccircuit
+
+import (
+  "context"
+
+  "google.golang.org/grpc"
+)
+
+// UnaryServerInterceptor calls the handlers through the circuit breakers, keyed by the full
+// method name (the target is empty on the server side). While a circuit is open, the RPCs
+// fail with the Unavailable code without calling the handler, which sheds the load while the
+// dependencies of the handler recover. The handler is not called either when the deadline
+// of the RPC is already exceeded. The errors of the handler are classified with
+// DefaultServerCodeClassifier, and a handler failing because the deadline of the client is
+// exceeded is not counted.
+func (i *Interceptor) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+  return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+    var resp interface{}
+    err := i.Breakers.DoContext(ctx, i.key("", info.FullMethod), func(ctx context.Context) error {
+      var err error
+      resp, err = handler(ctx, req)
+      return newHandlerError(ctx, err)
+    })
+    return resp, toStatusError(err)
+  }
+}
+
+// StreamServerInterceptor is the streaming counterpart of UnaryServerInterceptor,
+// the outcome of a stream is the error returned by its handler.
+func (i *Interceptor) StreamServerInterceptor() grpc.StreamServerInterceptor {
+  return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+    err := i.Breakers.DoContext(ss.Context(), i.key("", info.FullMethod), func(ctx context.Context) error {
+      return newHandlerError(ctx, handler(srv, ss))
+    })
+    return toStatusError(err)
+  }
+}
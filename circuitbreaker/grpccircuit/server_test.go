@@ -0,0 +1,122 @@
+package grpccircuit
+
+import (
+  "context"
+  "errors"
+  "strings"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/ocampeau/gutils/circuitbreaker"
+  "github.com/prometheus/client_golang/prometheus/testutil"
+  "github.com/stretchr/testify/assert"
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+)
+
+func TestUnaryServerInterceptorShouldShedTheLoad(t *testing.T) {
+  i := NewInterceptor("health", WithBreakerOptions(circuitbreaker.WithFailuresThreshold(2)))
+  defer i.Close()
+  col := NewPromCollector(i)
+  srv := &healthServer{code: uint32(codes.Unavailable)}
+  conn := startServer(t, "bufnet", srv, []grpc.ServerOption{grpc.UnaryInterceptor(i.UnaryServerInterceptor())})
+
+  check(conn)
+  check(conn)
+  err := check(conn)
+  assert.Equal(t, codes.Unavailable, status.Code(err))
+  assert.Contains(t, status.Convert(err).Message(), circuitbreaker.ErrCircuitOpen.Error())
+  assert.Equal(t, uint32(2), atomic.LoadUint32(&srv.calls), "the handler should not be called when the circuit is open")
+
+  // the other methods have their own circuit breaker
+  srv.setCode(codes.OK)
+  assert.NoError(t, watch(conn))
+
+  expected := `
+# HELP circuit_breaker_open_state A counter indicating the number of times the circuit has been in the open state
+# TYPE circuit_breaker_open_state counter
+circuit_breaker_open_state{circuit_breaker_key="/grpc.health.v1.Health/Check",circuit_breaker_name="health"} 1
+`
+  assert.Nil(t, testutil.CollectAndCompare(col, strings.NewReader(expected), "circuit_breaker_open_state"))
+}
+
+func TestUnaryServerInterceptorShouldCountClientErrorsAsSuccesses(t *testing.T) {
+  i := NewInterceptor("health", WithBreakerOptions(circuitbreaker.WithFailuresThreshold(1)))
+  defer i.Close()
+  conn := startServer(t, "bufnet", &healthServer{code: uint32(codes.NotFound)}, []grpc.ServerOption{grpc.UnaryInterceptor(i.UnaryServerInterceptor())})
+
+  for j := 0; j < 3; j++ {
+    assert.Equal(t, codes.NotFound, status.Code(check(conn)))
+  }
+  assert.Equal(t, circuitbreaker.Closed, i.Breakers.Get("/grpc.health.v1.Health/Check").State())
+}
+
+func TestUnaryServerInterceptorShouldCountTheHandlerErrors(t *testing.T) {
+  i := NewInterceptor("health", WithBreakerOptions(circuitbreaker.WithFailuresThreshold(2)))
+  defer i.Close()
+
+  var calls int
+  handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+    calls++
+    return nil, errors.New("db down")
+  }
+  info := &grpc.UnaryServerInfo{FullMethod: "/test/Method"}
+
+  _, err := i.UnaryServerInterceptor()(context.Background(), nil, info, handler)
+  assert.EqualError(t, err, "db down", "the error of the handler should be returned unchanged")
+  i.UnaryServerInterceptor()(context.Background(), nil, info, handler)
+
+  _, err = i.UnaryServerInterceptor()(context.Background(), nil, info, handler)
+  assert.Equal(t, codes.Unavailable, status.Code(err))
+  assert.Equal(t, 2, calls)
+  assert.Equal(t, circuitbreaker.Open, i.Breakers.Get("/test/Method").State())
+}
+
+func TestUnaryServerInterceptorShouldNotCountTheDeadlineOfTheClient(t *testing.T) {
+  i := NewInterceptor("health", WithBreakerOptions(circuitbreaker.WithFailuresThreshold(1)))
+  defer i.Close()
+
+  handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+    <-ctx.Done()
+    return nil, status.FromContextError(ctx.Err()).Err()
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+  defer cancel()
+
+  _, err := i.UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/test/Method"}, handler)
+  assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+  cb := i.Breakers.Get("/test/Method")
+  assert.Equal(t, circuitbreaker.Closed, cb.State())
+  assert.Equal(t, uint64(0), cb.Stats().Failures)
+}
+
+func TestUnaryServerInterceptorShouldRespectTheDeadline(t *testing.T) {
+  i := NewInterceptor("health")
+  defer i.Close()
+
+  var calls int
+  handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+    calls++
+    return nil, nil
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+  defer cancel()
+
+  _, err := i.UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/test/Method"}, handler)
+  assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+  assert.Equal(t, 0, calls, "the handler should not be called once the deadline is exceeded")
+}
+
+func TestStreamServerInterceptorShouldShedTheLoad(t *testing.T) {
+  i := NewInterceptor("health", WithBreakerOptions(circuitbreaker.WithFailuresThreshold(1)))
+  defer i.Close()
+  srv := &healthServer{code: uint32(codes.Internal)}
+  conn := startServer(t, "bufnet", srv, []grpc.ServerOption{grpc.StreamInterceptor(i.StreamServerInterceptor())})
+
+  assert.Equal(t, codes.Internal, status.Code(watch(conn)))
+  assert.Equal(t, codes.Unavailable, status.Code(watch(conn)))
+  assert.Equal(t, uint32(1), atomic.LoadUint32(&srv.calls))
+  assert.Equal(t, circuitbreaker.Open, i.Breakers.Get("/grpc.health.v1.Health/Watch").State())
+}
@@ -0,0 +1,118 @@
+package circuitbreaker
+
+import (
+  "sync"
+  "sync/atomic"
+)
+
+// hookList is a copy-on-write list of hooks. The hooks are called from the request
+// goroutines without any lock, the registrations are serialized and replace the list.
+type hookList[T any] struct {
+  lock  sync.Mutex
+  hooks atomic.Value // []*T
+}
+
+// add registers the hook and returns the function removing it from the list
+func (l *hookList[T]) add(h T) func() {
+  entry := &h
+
+  l.lock.Lock()
+  old := l.load()
+  hooks := make([]*T, len(old), len(old)+1)
+  copy(hooks, old)
+  l.hooks.Store(append(hooks, entry))
+  l.lock.Unlock()
+
+  var once sync.Once
+  return func() {
+    once.Do(func() { l.remove(entry) })
+  }
+}
+
+func (l *hookList[T]) remove(entry *T) {
+  l.lock.Lock()
+  defer l.lock.Unlock()
+
+  old := l.load()
+  hooks := make([]*T, 0, len(old))
+  for _, h := range old {
+    if h != entry {
+      hooks = append(hooks, h)
+    }
+  }
+  l.hooks.Store(hooks)
+}
+
+func (l *hookList[T]) load() []*T {
+  hooks, _ := l.hooks.Load().([]*T)
+  return hooks
+}
+
+// hookQueue runs the hooks in a single goroutine, so a slow hook does not add latency
+// to the request that triggered it. The hooks are dropped when the queue is full.
+type hookQueue struct {
+  tasks   chan func()
+  done    chan struct{}
+  stop    sync.Once
+  dropped uint64
+}
+
+func newHookQueue(size int) *hookQueue {
+  q := &hookQueue{
+    tasks: make(chan func(), size),
+    done:  make(chan struct{}),
+  }
+  go q.run()
+  return q
+}
+
+func (q *hookQueue) run() {
+  for {
+    select {
+    case task := <-q.tasks:
+      task()
+    case <-q.done:
+      // run the hooks queued before the queue was closed
+      for {
+        select {
+        case task := <-q.tasks:
+          task()
+        default:
+          return
+        }
+      }
+    }
+  }
+}
+
+func (q *hookQueue) dispatch(task func()) {
+  select {
+  case q.tasks <- task:
+  default:
+    atomic.AddUint64(&q.dropped, 1)
+  }
+}
+
+func (q *hookQueue) close() {
+  q.stop.Do(func() { close(q.done) })
+}
+
+// WithAsyncHooks runs the listeners and the hooks in a background goroutine instead of the
+// goroutine of the request. At most queueSize calls are queued, the others are dropped and
+// counted by DroppedHooks. The goroutine is stopped by Close.
+func WithAsyncHooks(queueSize int) func(breaker *CircuitBreaker) {
+  return func(breaker *CircuitBreaker) {
+    if breaker.hookQueue != nil {
+      breaker.hookQueue.close()
+    }
+    breaker.hookQueue = newHookQueue(queueSize)
+  }
+}
+
+// DroppedHooks returns the number of hook calls dropped because the async queue was full.
+func (c *CircuitBreaker) DroppedHooks() uint64 {
+  if c.hookQueue == nil {
+    return 0
+  }
+  return atomic.LoadUint64(&c.hookQueue.dropped)
+}
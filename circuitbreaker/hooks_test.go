@@ -0,0 +1,101 @@
+package circuitbreaker
+
+import (
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestUnsubscribeShouldRemoveTheHook(t *testing.T) {
+  cb := NewCircuitBreaker("test")
+
+  var numOpen, numListener int
+  unsubscribe := cb.RegisterOnOpenHooks(func() {
+    numOpen++
+  })
+  cb.RegisterListener(func(event StateChangeEvent) {
+    numListener++
+  })
+
+  cb.ForceOpen()
+  unsubscribe()
+  unsubscribe()
+  cb.Reset()
+  cb.openCircuit(Closed, nil)
+
+  assert.Equal(t, 0, numOpen, "a forced open is not an open")
+  assert.Equal(t, 3, numListener)
+}
+
+func TestUnsubscribeShouldOnlyRemoveItsHook(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFallback(func(err error) error { return nil }))
+  cb.ForceOpen()
+
+  var calls []int
+  unsubscribe := cb.RegisterOnFallbackHooks(func(err error) { calls = append(calls, 1) })
+  cb.RegisterOnFallbackHooks(func(err error) { calls = append(calls, 2) })
+
+  cb.Do(func() error { return nil })
+  unsubscribe()
+  cb.Do(func() error { return nil })
+
+  assert.Equal(t, []int{1, 2, 2}, calls)
+}
+
+func TestHookRegistrationConcurrent(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailuresThreshold(1))
+
+  var numOpen uint32
+  wg := sync.WaitGroup{}
+  for i := 0; i < 8; i++ {
+    wg.Add(2)
+    go func() {
+      defer wg.Done()
+      for j := 0; j < 100; j++ {
+        unsubscribe := cb.RegisterOnOpenHooks(func() {
+          atomic.AddUint32(&numOpen, 1)
+        })
+        unsubscribe()
+      }
+    }()
+    go func() {
+      defer wg.Done()
+      for j := 0; j < 100; j++ {
+        cb.Do(func() error { return ErrCircuitInternal })
+        cb.Reset()
+      }
+    }()
+  }
+  wg.Wait()
+
+  assert.Empty(t, cb.listeners.load())
+}
+
+func TestAsyncHooksShouldNotBlockTheCaller(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailuresThreshold(1), WithAsyncHooks(1))
+
+  release := make(chan struct{})
+  events := make(chan StateChangeEvent, 10)
+  cb.RegisterListener(func(event StateChangeEvent) {
+    <-release
+    events <- event
+  })
+
+  // the first event blocks the dispatch goroutine, the second one fills the queue
+  // and the third one is dropped
+  cb.Do(func() error { return ErrCircuitInternal })
+  assert.Eventually(t, func() bool { return len(cb.hookQueue.tasks) == 0 }, time.Second, time.Millisecond)
+  cb.Reset()
+  cb.ForceOpen()
+  assert.Equal(t, uint64(1), cb.DroppedHooks())
+
+  close(release)
+  assert.Equal(t, Open, (<-events).To)
+  assert.Equal(t, Closed, (<-events).To)
+
+  cb.Close()
+  assert.Equal(t, Stopped, (<-events).To, "the hooks queued before Close should run")
+}
@@ -1,27 +1,301 @@
 package circuitbreaker
 
 import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "io"
   "net/http"
+  "strconv"
+  "time"
 )
 
+type HttpOptions func(t *HttpTransport)
+type HostKeyFunc = func(req *http.Request) string
+
+// ResponseClassifier returns true when the result of a request is a failure
+// that should be counted by the circuit breaker.
+type ResponseClassifier = func(res *http.Response, err error) bool
+
+// OpenResponseFunc creates the response returned in place of an error when the circuit
+// rejects a request. `retryAfter` is the time left before the circuit goes half-open,
+// or 0 if it is not known.
+type OpenResponseFunc = func(req *http.Request, cb *CircuitBreaker, retryAfter time.Duration) *http.Response
+
+// HeaderCircuitBreaker is set to the name of the circuit breaker in the responses created
+// when the circuit is open
+const HeaderCircuitBreaker = "X-Circuit-Breaker"
+
 type HttpTransport struct {
   next    http.RoundTripper
   Circuit *CircuitBreaker
+  // Hosts holds the circuit breaker of each host in per-host mode, Circuit is nil in that case
+  Hosts       *KeyedCircuitBreaker
+  name        string
+  breakerOpts []Options
+  perHost     bool
+  maxHosts    int
+  hostTTL     time.Duration
+  hostKey     HostKeyFunc
+  isFailure   ResponseClassifier
+  retryAfter  bool
+  maxRetry    time.Duration
+  openResp    OpenResponseFunc
 }
 
 func NewHttpTransportCircuitBreaker(name string, rt http.RoundTripper, opts ...Options) *HttpTransport {
+  return NewHttpTransport(name, rt, WithBreakerOptions(opts...))
+}
+
+// NewHttpTransport creates an http.RoundTripper that sends the requests to `rt` through a
+// circuit breaker, configured with the HttpOptions.
+func NewHttpTransport(name string, rt http.RoundTripper, opts ...HttpOptions) *HttpTransport {
   tr := HttpTransport{
-    next:    rt,
-    Circuit: NewCircuitBreaker(name, opts...),
+    next:      rt,
+    name:      name,
+    hostKey:   requestHost,
+    isFailure: DefaultResponseClassifier,
+  }
+  for _, apply := range opts {
+    apply(&tr)
+  }
+
+  if tr.perHost {
+    tr.Hosts = NewKeyedCircuitBreaker(name, tr.maxHosts, tr.hostTTL, tr.breakerOpts...)
+  } else {
+    tr.Circuit = NewCircuitBreaker(name, tr.breakerOpts...)
   }
   return &tr
 }
 
 func (t *HttpTransport) RoundTrip(req *http.Request) (res *http.Response, err error) {
-  op := func() error {
+  cb, e := t.circuitFor(req)
+  defer t.Hosts.release(e)
+  op := func(ctx context.Context) error {
     res, err = t.next.RoundTrip(req)
-    return err
+    if !t.isFailure(res, err) {
+      // the error is still returned to the caller below, but not counted
+      return nil
+    }
+    if err != nil {
+      return err
+    }
+
+    // the circuit breaker only knows about errors, the response is still given to the caller
+    statusErr := &HttpStatusError{Response: res}
+    if d := t.retryAfterDuration(res, cb.clock.Now()); d > 0 {
+      cb.tripFor(d, statusErr)
+    }
+    return statusErr
+  }
+  cbErr := cb.DoContext(req.Context(), op)
+
+  var statusErr *HttpStatusError
+  switch {
+  case cbErr == nil && res == nil && err == nil:
+    // a fallback replaced the rejection, but a RoundTripper must return a response or an error
+    if t.openResp != nil {
+      return t.openResponse(req, cb), nil
+    }
+    return nil, ErrCircuitOpen
+  case cbErr == nil:
+    return
+  case errors.As(cbErr, &statusErr) && statusErr.Response == res:
+    return res, nil
+  case t.openResp != nil && IsRejection(cbErr) && req.Context().Err() == nil:
+    return t.openResponse(req, cb), nil
+  }
+  if res != nil {
+    // the failure was replaced by the error of a fallback
+    res.Body.Close()
+  }
+  return nil, cbErr
+}
+
+// circuitFor returns the circuit breaker of the request, with the entry to release once
+// the request is done when there is one circuit breaker per host
+func (t *HttpTransport) circuitFor(req *http.Request) (*CircuitBreaker, *keyedEntry) {
+  if t.Hosts != nil {
+    e := t.Hosts.acquire(t.hostKey(req))
+    return e.cb, e
+  }
+  return t.Circuit, nil
+}
+
+func (t *HttpTransport) openResponse(req *http.Request, cb *CircuitBreaker) *http.Response {
+  res := t.openResp(req, cb, timeUntilHalfOpen(cb))
+  if res.Header == nil {
+    res.Header = http.Header{}
+  }
+  res.Header.Set(HeaderCircuitBreaker, cb.Name())
+  return res
+}
+
+// timeUntilHalfOpen returns the time left before the circuit goes half-open, or 0 if it is not known
+func timeUntilHalfOpen(cb *CircuitBreaker) time.Duration {
+  if next := cb.Stats().NextTransition; !next.IsZero() {
+    return next.Sub(cb.clock.Now())
+  }
+  return 0
+}
+
+// retryAfterSeconds formats a Retry-After header, rounded up so the client
+// does not come back before the circuit is half-open
+func retryAfterSeconds(d time.Duration) string {
+  return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// DefaultOpenResponse is a 503 response with a JSON body, and a Retry-After
+// header when the time before the circuit goes half-open is known.
+func DefaultOpenResponse(req *http.Request, cb *CircuitBreaker, retryAfter time.Duration) *http.Response {
+  body, _ := json.Marshal(struct {
+    Error          string `json:"error"`
+    CircuitBreaker string `json:"circuit_breaker"`
+    State          State  `json:"state"`
+  }{ErrCircuitOpen.Error(), cb.Name(), cb.State()})
+
+  header := http.Header{"Content-Type": {"application/json"}}
+  if retryAfter > 0 {
+    header.Set("Retry-After", retryAfterSeconds(retryAfter))
+  }
+  return NewHttpResponse(req, http.StatusServiceUnavailable, header, body)
+}
+
+// NewHttpResponse creates a response to `req` that did not come from the network,
+// to be returned by an OpenResponseFunc.
+func NewHttpResponse(req *http.Request, status int, header http.Header, body []byte) *http.Response {
+  return &http.Response{
+    Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+    StatusCode:    status,
+    Proto:         "HTTP/1.1",
+    ProtoMajor:    1,
+    ProtoMinor:    1,
+    Header:        header,
+    Body:          io.NopCloser(bytes.NewReader(body)),
+    ContentLength: int64(len(body)),
+    Request:       req,
+  }
+}
+
+func requestHost(req *http.Request) string {
+  return req.URL.Host
+}
+
+// DefaultResponseClassifier counts the transport errors, the 5xx responses and
+// the 429 responses as failures. The other 4xx responses are successes, since
+// they are caused by the request and not by the server.
+func DefaultResponseClassifier(res *http.Response, err error) bool {
+  if err != nil {
+    return true
+  }
+  return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+}
+
+// retryAfterDuration returns how long the server asked to wait before sending other requests,
+// or 0 if it did not or if the transport does not honor it
+func (t *HttpTransport) retryAfterDuration(res *http.Response, now time.Time) time.Duration {
+  if !t.retryAfter {
+    return 0
+  }
+
+  var d time.Duration
+  if v := res.Header.Get("Retry-After"); v != "" {
+    if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+      d = time.Duration(seconds) * time.Second
+    } else if date, err := http.ParseTime(v); err == nil {
+      d = date.Sub(now)
+    }
+  } else if v := res.Header.Get("RateLimit-Reset"); v != "" {
+    d = parseRateLimitReset(v, now)
+  } else if v := res.Header.Get("X-RateLimit-Reset"); v != "" {
+    d = parseRateLimitReset(v, now)
+  }
+
+  if t.maxRetry > 0 && d > t.maxRetry {
+    d = t.maxRetry
+  }
+  return d
+}
+
+// parseRateLimitReset parses a number of seconds before the reset or, for the APIs that
+// use this form, the unix time of the reset
+func parseRateLimitReset(v string, now time.Time) time.Duration {
+  n, err := strconv.ParseInt(v, 10, 64)
+  if err != nil || n <= 0 {
+    return 0
+  }
+  if n >= unixTimeThreshold {
+    return time.Unix(n, 0).Sub(now)
+  }
+  return time.Duration(n) * time.Second
+}
+
+// a reset value above this threshold (2001-09-09) is a unix time rather than a number of seconds
+const unixTimeThreshold = 1_000_000_000
+
+// HttpStatusError is the error seen by the circuit breaker, its failure predicate and its
+// fallback when a response is classified as a failure. It is not returned by RoundTrip,
+// the caller receives the response instead.
+type HttpStatusError struct {
+  Response *http.Response
+}
+
+func (e *HttpStatusError) Error() string {
+  return "http response classified as a failure: " + e.Response.Status
+}
+
+// WithBreakerOptions gives options to the circuit breakers of the transport.
+func WithBreakerOptions(opts ...Options) func(t *HttpTransport) {
+  return func(t *HttpTransport) {
+    t.breakerOpts = append(t.breakerOpts, opts...)
+  }
+}
+
+// WithPerHost creates one circuit breaker per host instead of a single one for all the requests,
+// so a failing host does not open the circuit for the others. The circuit breakers are kept in
+// a KeyedCircuitBreaker, bounded by `maxHosts` and `ttl`.
+func WithPerHost(maxHosts int, ttl time.Duration) func(t *HttpTransport) {
+  return func(t *HttpTransport) {
+    t.perHost = true
+    t.maxHosts = maxHosts
+    t.hostTTL = ttl
+  }
+}
+
+// WithResponseClassifier replaces DefaultResponseClassifier to decide which responses
+// are failures. The transport errors are always given to the circuit breaker.
+func WithResponseClassifier(isFailure ResponseClassifier) func(t *HttpTransport) {
+  return func(t *HttpTransport) {
+    t.isFailure = isFailure
+  }
+}
+
+// WithRetryAfter opens the circuit as soon as a failed response carries a Retry-After header
+// (in seconds or as an HTTP date), or a RateLimit-Reset or X-RateLimit-Reset header. The
+// circuit stays open for the duration asked by the server, capped to `max` if it is not 0,
+// in place of the open duration of the circuit breaker.
+func WithRetryAfter(max time.Duration) func(t *HttpTransport) {
+  return func(t *HttpTransport) {
+    t.retryAfter = true
+    t.maxRetry = max
+  }
+}
+
+// WithOpenResponse returns the response created by `f` instead of an error when the circuit
+// rejects a request, for the callers that handle the errors of a RoundTripper poorly, like
+// httputil.ReverseProxy. DefaultOpenResponse can be used as `f`. The rejections caused
+// by a context that is already done are still returned as errors.
+func WithOpenResponse(f OpenResponseFunc) func(t *HttpTransport) {
+  return func(t *HttpTransport) {
+    t.openResp = f
+  }
+}
+
+// WithHostKey replaces the host of the request as the key of the circuit breakers in
+// per-host mode, for example to also use a prefix of the path.
+func WithHostKey(key HostKeyFunc) func(t *HttpTransport) {
+  return func(t *HttpTransport) {
+    t.hostKey = key
   }
-  err = t.Circuit.Do(op)
-  return
 }
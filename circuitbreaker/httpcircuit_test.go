@@ -0,0 +1,374 @@
+package circuitbreaker
+
+import (
+  "context"
+  "errors"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "net/http/httputil"
+  "net/url"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/ocampeau/gutils/circuitbreaker/clock"
+  "github.com/prometheus/client_golang/prometheus/testutil"
+  "github.com/stretchr/testify/assert"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+  return f(req)
+}
+
+var errConnRefused = errors.New("connection refused")
+
+// failingHost fails the requests sent to `host` with a transport error
+func failingHost(host string) http.RoundTripper {
+  return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+    if req.URL.Host == host {
+      return nil, errConnRefused
+    }
+    return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+  })
+}
+
+func newRequest(t *testing.T, url string) *http.Request {
+  req, err := http.NewRequest(http.MethodGet, url, nil)
+  assert.NoError(t, err)
+  return req
+}
+
+func TestHttpTransportShouldOpenForAllHosts(t *testing.T) {
+  tr := NewHttpTransportCircuitBreaker("test", failingHost("down.local"), WithFailuresThreshold(1))
+
+  _, err := tr.RoundTrip(newRequest(t, "http://down.local/"))
+  assert.ErrorIs(t, err, errConnRefused)
+  _, err = tr.RoundTrip(newRequest(t, "http://up.local/"))
+  assert.Equal(t, ErrCircuitOpen, err)
+}
+
+func TestHttpTransportPerHostShouldOnlyOpenForTheFailingHost(t *testing.T) {
+  tr := NewHttpTransport("test", failingHost("down.local"),
+    WithBreakerOptions(WithFailuresThreshold(1)),
+    WithPerHost(100, 0))
+  defer tr.Hosts.Close()
+  assert.Nil(t, tr.Circuit)
+
+  tr.RoundTrip(newRequest(t, "http://down.local/"))
+  _, err := tr.RoundTrip(newRequest(t, "http://down.local/"))
+  assert.Equal(t, ErrCircuitOpen, err)
+
+  res, err := tr.RoundTrip(newRequest(t, "http://up.local/"))
+  assert.NoError(t, err)
+  assert.Equal(t, http.StatusOK, res.StatusCode)
+  assert.Equal(t, Open, tr.Hosts.Get("down.local").State())
+}
+
+func TestHttpTransportPerHostWithHostKey(t *testing.T) {
+  tr := NewHttpTransport("test", failingHost("api.local"),
+    WithBreakerOptions(WithFailuresThreshold(1)),
+    WithPerHost(100, 0),
+    WithHostKey(func(req *http.Request) string {
+      return req.URL.Host + "/" + strings.Split(req.URL.Path, "/")[1]
+    }))
+  defer tr.Hosts.Close()
+
+  tr.RoundTrip(newRequest(t, "http://api.local/users/1"))
+  assert.Equal(t, Open, tr.Hosts.Get("api.local/users").State())
+  assert.Equal(t, Closed, tr.Hosts.Get("api.local/orders").State())
+}
+
+func TestHttpTransportPromCollectorShouldExportTheHost(t *testing.T) {
+  tr := NewHttpTransport("test", failingHost("down.local"),
+    WithBreakerOptions(WithFailuresThreshold(1)),
+    WithPerHost(100, 0))
+  defer tr.Hosts.Close()
+  col := NewHttpTransportPromCollector(tr)
+
+  tr.RoundTrip(newRequest(t, "http://down.local/"))
+  tr.RoundTrip(newRequest(t, "http://up.local/"))
+
+  expected := `
+# HELP circuit_breaker_open_state A counter indicating the number of times the circuit has been in the open state
+# TYPE circuit_breaker_open_state counter
+circuit_breaker_open_state{circuit_breaker_key="down.local",circuit_breaker_name="test"} 1
+circuit_breaker_open_state{circuit_breaker_key="up.local",circuit_breaker_name="test"} 0
+`
+  assert.Nil(t, testutil.CollectAndCompare(col, strings.NewReader(expected), "circuit_breaker_open_state"))
+}
+
+// statusServer answers every request with `status` and the body "status body"
+func statusServer(status int) *httptest.Server {
+  return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(status)
+    io.WriteString(w, "status body")
+  }))
+}
+
+func TestHttpTransportShouldCountServerErrorsAsFailures(t *testing.T) {
+  for _, status := range []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+    srv := statusServer(status)
+    client := http.Client{Transport: NewHttpTransportCircuitBreaker("test", http.DefaultTransport, WithFailuresThreshold(2))}
+
+    for i := 0; i < 2; i++ {
+      res, err := client.Get(srv.URL)
+      if assert.NoError(t, err) {
+        body, _ := io.ReadAll(res.Body)
+        res.Body.Close()
+        assert.Equal(t, status, res.StatusCode)
+        assert.Equal(t, "status body", string(body), "the body of a failed response should be intact")
+      }
+    }
+
+    _, err := client.Get(srv.URL)
+    assert.ErrorIs(t, err, ErrCircuitOpen, "status %d should be a failure", status)
+    srv.Close()
+  }
+}
+
+func TestHttpTransportShouldCountClientErrorsAsSuccesses(t *testing.T) {
+  srv := statusServer(http.StatusNotFound)
+  defer srv.Close()
+  tr := NewHttpTransportCircuitBreaker("test", http.DefaultTransport, WithFailuresThreshold(1))
+
+  for i := 0; i < 3; i++ {
+    res, err := tr.RoundTrip(newRequest(t, srv.URL))
+    if assert.NoError(t, err) {
+      res.Body.Close()
+      assert.Equal(t, http.StatusNotFound, res.StatusCode)
+    }
+  }
+  assert.Equal(t, Closed, tr.Circuit.State())
+}
+
+func TestHttpTransportWithResponseClassifier(t *testing.T) {
+  srv := statusServer(http.StatusNotFound)
+  defer srv.Close()
+
+  // a 404 is a failure, but a refused connection is not
+  rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+    if req.URL.Path == "/refused" {
+      return nil, errConnRefused
+    }
+    return http.DefaultTransport.RoundTrip(req)
+  })
+  tr := NewHttpTransport("test", rt,
+    WithBreakerOptions(WithFailuresThreshold(1)),
+    WithResponseClassifier(func(res *http.Response, err error) bool {
+      return err == nil && res.StatusCode == http.StatusNotFound
+    }))
+
+  _, err := tr.RoundTrip(newRequest(t, srv.URL+"/refused"))
+  assert.Equal(t, errConnRefused, err)
+  assert.Equal(t, Closed, tr.Circuit.State())
+
+  res, err := tr.RoundTrip(newRequest(t, srv.URL))
+  if assert.NoError(t, err) {
+    res.Body.Close()
+  }
+  assert.Equal(t, Open, tr.Circuit.State())
+}
+
+func TestHttpTransportShouldCloseTheResponseReplacedByAFallback(t *testing.T) {
+  srv := statusServer(http.StatusInternalServerError)
+  defer srv.Close()
+
+  errFallback := errors.New("fallback")
+  tr := NewHttpTransportCircuitBreaker("test", http.DefaultTransport,
+    WithFallback(func(err error) error {
+      var statusErr *HttpStatusError
+      assert.ErrorAs(t, err, &statusErr)
+      return errFallback
+    }),
+    WithFallbackOnFailure())
+
+  res, err := tr.RoundTrip(newRequest(t, srv.URL))
+  assert.Nil(t, res)
+  assert.Equal(t, errFallback, err)
+}
+
+func TestHttpTransportShouldNotReturnANilResponseWhenAFallbackReplacesTheRejection(t *testing.T) {
+  fallback := WithBreakerOptions(WithFallback(func(err error) error { return nil }))
+
+  tr := NewHttpTransport("backend", http.DefaultTransport, fallback)
+  tr.Circuit.ForceOpen()
+  res, err := tr.RoundTrip(newRequest(t, "http://backend.local/"))
+  assert.Nil(t, res)
+  assert.Equal(t, ErrCircuitOpen, err)
+
+  tr = NewHttpTransport("backend", http.DefaultTransport, fallback, WithOpenResponse(DefaultOpenResponse))
+  tr.Circuit.ForceOpen()
+  res, err = tr.RoundTrip(newRequest(t, "http://backend.local/"))
+  if assert.NoError(t, err) {
+    assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+  }
+}
+
+// retryAfterServer answers every request with `status` and the given header
+func retryAfterServer(status int, header, value string) *httptest.Server {
+  return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set(header, value)
+    w.WriteHeader(status)
+  }))
+}
+
+func TestHttpTransportShouldStayOpenForTheRetryAfterPeriod(t *testing.T) {
+  start := time.Unix(1700000000, 0)
+  testCases := []struct {
+    name   string
+    status int
+    header string
+    value  string
+    period time.Duration
+  }{
+    {"retry after in seconds", http.StatusServiceUnavailable, "Retry-After", "7", 7 * time.Second},
+    {"retry after as a date", http.StatusTooManyRequests, "Retry-After", start.Add(12 * time.Second).UTC().Format(http.TimeFormat), 12 * time.Second},
+    {"rate limit reset", http.StatusTooManyRequests, "RateLimit-Reset", "20", 20 * time.Second},
+    {"rate limit reset as a unix time", http.StatusTooManyRequests, "X-RateLimit-Reset", "1700000030", 30 * time.Second},
+  }
+
+  for _, tc := range testCases {
+    t.Run(tc.name, func(t *testing.T) {
+      srv := retryAfterServer(tc.status, tc.header, tc.value)
+      defer srv.Close()
+
+      clk := clock.NewFake(start)
+      tr := NewHttpTransport("test", http.DefaultTransport,
+        WithBreakerOptions(WithClock(clk), WithOpenDuration(time.Second)),
+        WithRetryAfter(time.Minute))
+
+      res, err := tr.RoundTrip(newRequest(t, srv.URL))
+      if assert.NoError(t, err) {
+        res.Body.Close()
+        assert.Equal(t, tc.status, res.StatusCode)
+      }
+      assert.Equal(t, Open, tr.Circuit.State(), "the circuit should open on the first response")
+      assert.Equal(t, tc.period, tr.Circuit.OpenDuration())
+
+      clk.Advance(tc.period - time.Nanosecond)
+      _, err = tr.RoundTrip(newRequest(t, srv.URL))
+      assert.Equal(t, ErrCircuitOpen, err)
+
+      clk.Advance(time.Nanosecond)
+      assert.Equal(t, HalfOpen, tr.Circuit.State())
+    })
+  }
+}
+
+func TestHttpTransportShouldCapTheRetryAfterPeriod(t *testing.T) {
+  srv := retryAfterServer(http.StatusServiceUnavailable, "Retry-After", "3600")
+  defer srv.Close()
+
+  tr := NewHttpTransport("test", http.DefaultTransport, WithRetryAfter(10*time.Second))
+  res, err := tr.RoundTrip(newRequest(t, srv.URL))
+  if assert.NoError(t, err) {
+    res.Body.Close()
+  }
+  assert.Equal(t, 10*time.Second, tr.Circuit.OpenDuration())
+  tr.Circuit.Close()
+}
+
+func TestHttpTransportShouldIgnoreRetryAfterByDefault(t *testing.T) {
+  srv := retryAfterServer(http.StatusServiceUnavailable, "Retry-After", "10")
+  defer srv.Close()
+
+  tr := NewHttpTransportCircuitBreaker("test", http.DefaultTransport)
+  res, err := tr.RoundTrip(newRequest(t, srv.URL))
+  if assert.NoError(t, err) {
+    res.Body.Close()
+  }
+  assert.Equal(t, Closed, tr.Circuit.State())
+}
+
+func TestHttpTransportShouldIgnoreRetryAfterOnSuccess(t *testing.T) {
+  srv := retryAfterServer(http.StatusOK, "RateLimit-Reset", "10")
+  defer srv.Close()
+
+  tr := NewHttpTransport("test", http.DefaultTransport, WithRetryAfter(0))
+  res, err := tr.RoundTrip(newRequest(t, srv.URL))
+  if assert.NoError(t, err) {
+    res.Body.Close()
+  }
+  assert.Equal(t, Closed, tr.Circuit.State())
+}
+
+func TestHttpTransportShouldReturnTheOpenResponse(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  tr := NewHttpTransport("backend", failingHost("down.local"),
+    WithBreakerOptions(WithClock(clk), WithFailuresThreshold(1), WithOpenDuration(10*time.Second)),
+    WithOpenResponse(DefaultOpenResponse))
+
+  _, err := tr.RoundTrip(newRequest(t, "http://down.local/"))
+  assert.ErrorIs(t, err, errConnRefused)
+
+  clk.Advance(2500 * time.Millisecond)
+  res, err := tr.RoundTrip(newRequest(t, "http://down.local/"))
+  if assert.NoError(t, err) {
+    body, _ := io.ReadAll(res.Body)
+    assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+    assert.Equal(t, "503 Service Unavailable", res.Status)
+    assert.Equal(t, "8", res.Header.Get("Retry-After"))
+    assert.Equal(t, "backend", res.Header.Get(HeaderCircuitBreaker))
+    assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+    assert.JSONEq(t, `{"error":"http circuit breaker is open","circuit_breaker":"backend","state":"open"}`, string(body))
+  }
+
+  // the time before a forced open circuit goes half-open is not known
+  tr.Circuit.ForceOpen()
+  res, err = tr.RoundTrip(newRequest(t, "http://down.local/"))
+  if assert.NoError(t, err) {
+    assert.Empty(t, res.Header.Get("Retry-After"))
+  }
+  // a stopped circuit breaker rejects the requests as well
+  tr.Circuit.Close()
+  res, err = tr.RoundTrip(newRequest(t, "http://down.local/"))
+  if assert.NoError(t, err) {
+    assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+  }
+}
+
+func TestHttpTransportShouldSetTheBreakerNameOnACustomOpenResponse(t *testing.T) {
+  tr := NewHttpTransport("backend", failingHost("down.local"),
+    WithPerHost(10, 0),
+    WithOpenResponse(func(req *http.Request, cb *CircuitBreaker, retryAfter time.Duration) *http.Response {
+      return NewHttpResponse(req, http.StatusTooManyRequests, nil, []byte("slow down"))
+    }))
+  tr.Hosts.Get("down.local").ForceOpen()
+  defer tr.Hosts.Close()
+
+  res, err := tr.RoundTrip(newRequest(t, "http://down.local/"))
+  if assert.NoError(t, err) {
+    body, _ := io.ReadAll(res.Body)
+    assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+    assert.Equal(t, "backend/down.local", res.Header.Get(HeaderCircuitBreaker))
+    assert.Equal(t, "slow down", string(body))
+  }
+}
+
+func TestHttpTransportOpenResponseWithReverseProxy(t *testing.T) {
+  tr := NewHttpTransport("backend", http.DefaultTransport, WithOpenResponse(DefaultOpenResponse))
+  tr.Circuit.ForceOpen()
+
+  backend, _ := url.Parse("http://backend.local")
+  proxy := httputil.NewSingleHostReverseProxy(backend)
+  proxy.Transport = tr
+
+  rec := httptest.NewRecorder()
+  proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users", nil))
+  assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+  assert.Equal(t, "backend", rec.Header().Get(HeaderCircuitBreaker))
+}
+
+func TestHttpTransportShouldReturnTheErrorWhenTheContextIsDone(t *testing.T) {
+  tr := NewHttpTransport("backend", http.DefaultTransport, WithOpenResponse(DefaultOpenResponse))
+  tr.Circuit.ForceOpen()
+
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  res, err := tr.RoundTrip(newRequest(t, "http://backend.local/").WithContext(ctx))
+  assert.Nil(t, res)
+  assert.ErrorIs(t, err, context.Canceled)
+}
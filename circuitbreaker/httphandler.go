@@ -0,0 +1,208 @@
+package circuitbreaker
+
+import (
+  "bufio"
+  "context"
+  "errors"
+  "net"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+type HandlerOptions func(h *HttpHandler)
+type RouteFunc = func(r *http.Request) string
+
+// StatusClassifier returns true when a status code written by a handler is a failure.
+type StatusClassifier = func(status int) bool
+
+// HttpHandler is an http.Handler middleware that calls the next handler through a circuit
+// breaker, and answers with a 503 without calling it when the circuit is open. It protects
+// the handlers whose dependencies are failing, and sheds the load while they recover.
+type HttpHandler struct {
+  next    http.Handler
+  Circuit *CircuitBreaker
+  // Routes holds the circuit breaker of each route in per-route mode, Circuit is nil in that case
+  Routes      *KeyedCircuitBreaker
+  breakerOpts []Options
+  route       RouteFunc
+  maxRoutes   int
+  routeTTL    time.Duration
+  isFailure   StatusClassifier
+}
+
+// NewHttpHandler wraps `next` in a circuit breaker named `name`.
+func NewHttpHandler(name string, next http.Handler, opts ...HandlerOptions) *HttpHandler {
+  h := HttpHandler{
+    next:      next,
+    isFailure: DefaultStatusClassifier,
+  }
+  for _, apply := range opts {
+    apply(&h)
+  }
+
+  if h.route != nil {
+    h.Routes = NewKeyedCircuitBreaker(name, h.maxRoutes, h.routeTTL, h.breakerOpts...)
+  } else {
+    h.Circuit = NewCircuitBreaker(name, h.breakerOpts...)
+  }
+  return &h
+}
+
+// HttpMiddleware returns a function wrapping a handler in an HttpHandler, for the routers
+// that take middlewares in this form.
+func HttpMiddleware(name string, opts ...HandlerOptions) func(next http.Handler) http.Handler {
+  return func(next http.Handler) http.Handler {
+    return NewHttpHandler(name, next, opts...)
+  }
+}
+
+func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  cb, e := h.circuitFor(r)
+  defer h.Routes.release(e)
+  sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+  called := false
+  err := cb.DoContext(r.Context(), func(ctx context.Context) error {
+    called = true
+    h.next.ServeHTTP(sw.wrap(), r)
+    if !sw.hijacked && h.isFailure(sw.status) {
+      return &HandlerStatusError{StatusCode: sw.status}
+    }
+    return nil
+  })
+
+  var statusErr *HandlerStatusError
+  var panicErr *PanicError
+  switch {
+  case err == nil && called, sw.wroteHeader, errors.As(err, &statusErr):
+  case errors.As(err, &panicErr):
+    http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+  default:
+    // the handler was not called, because the circuit rejected the request (even
+    // if a fallback replaced the rejection) or because the request context is done
+    w.Header().Set(HeaderCircuitBreaker, cb.Name())
+    if d := timeUntilHalfOpen(cb); d > 0 {
+      w.Header().Set("Retry-After", retryAfterSeconds(d))
+    }
+    http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+  }
+}
+
+// circuitFor returns the circuit breaker of the request, with the entry to release once
+// the request is done when there is one circuit breaker per route
+func (h *HttpHandler) circuitFor(r *http.Request) (*CircuitBreaker, *keyedEntry) {
+  if h.Routes != nil {
+    e := h.Routes.acquire(h.route(r))
+    return e.cb, e
+  }
+  return h.Circuit, nil
+}
+
+// DefaultStatusClassifier counts the 5xx status codes as failures.
+func DefaultStatusClassifier(status int) bool {
+  return status >= 500
+}
+
+// HandlerStatusError is the error seen by the circuit breaker when a handler wrote a
+// status code classified as a failure.
+type HandlerStatusError struct {
+  StatusCode int
+}
+
+func (e *HandlerStatusError) Error() string {
+  return "http handler answered with status " + strconv.Itoa(e.StatusCode)
+}
+
+// WithHandlerBreakerOptions gives options to the circuit breakers of the handler.
+func WithHandlerBreakerOptions(opts ...Options) func(h *HttpHandler) {
+  return func(h *HttpHandler) {
+    h.breakerOpts = append(h.breakerOpts, opts...)
+  }
+}
+
+// WithStatusClassifier replaces DefaultStatusClassifier to decide which status codes are failures.
+func WithStatusClassifier(isFailure StatusClassifier) func(h *HttpHandler) {
+  return func(h *HttpHandler) {
+    h.isFailure = isFailure
+  }
+}
+
+// WithRoutes creates one circuit breaker per route returned by `route`, so a route whose
+// dependencies fail does not reject the requests of the others. The circuit breakers are
+// kept in a KeyedCircuitBreaker, bounded by `maxRoutes` and `ttl`.
+func WithRoutes(route RouteFunc, maxRoutes int, ttl time.Duration) func(h *HttpHandler) {
+  return func(h *HttpHandler) {
+    h.route = route
+    h.maxRoutes = maxRoutes
+    h.routeTTL = ttl
+  }
+}
+
+// statusWriter records the status code written by the handler
+type statusWriter struct {
+  http.ResponseWriter
+  status      int
+  wroteHeader bool
+  hijacked    bool
+}
+
+// wrap returns the statusWriter with the optional interfaces of the original ResponseWriter,
+// since the handlers discover them with type assertions
+func (w *statusWriter) wrap() http.ResponseWriter {
+  _, isFlusher := w.ResponseWriter.(http.Flusher)
+  _, isHijacker := w.ResponseWriter.(http.Hijacker)
+  switch {
+  case isFlusher && isHijacker:
+    return &flushHijackWriter{w}
+  case isFlusher:
+    return &flushWriter{w}
+  case isHijacker:
+    return &hijackWriter{w}
+  }
+  return w
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+  if !w.wroteHeader {
+    w.status = status
+    w.wroteHeader = true
+  }
+  w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+  w.wroteHeader = true
+  return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives access to the original ResponseWriter to http.ResponseController
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+  return w.ResponseWriter
+}
+
+func (w *statusWriter) flush() {
+  w.wroteHeader = true
+  w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (w *statusWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+  conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+  if err == nil {
+    w.hijacked = true
+  }
+  return conn, rw, err
+}
+
+type flushWriter struct{ *statusWriter }
+
+func (w *flushWriter) Flush() { w.flush() }
+
+type hijackWriter struct{ *statusWriter }
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) { return w.hijack() }
+
+type flushHijackWriter struct{ *statusWriter }
+
+func (w *flushHijackWriter) Flush() { w.flush() }
+
+func (w *flushHijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) { return w.hijack() }
@@ -0,0 +1,176 @@
+package circuitbreaker
+
+import (
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/ocampeau/gutils/circuitbreaker/clock"
+  "github.com/prometheus/client_golang/prometheus/testutil"
+  "github.com/stretchr/testify/assert"
+)
+
+func statusHandler(status int, calls *int) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    *calls++
+    w.WriteHeader(status)
+  })
+}
+
+func serve(h http.Handler, path string) *httptest.ResponseRecorder {
+  rec := httptest.NewRecorder()
+  h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+  return rec
+}
+
+func TestHttpHandlerShouldRejectWhenOpen(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  var calls int
+  h := NewHttpHandler("api", statusHandler(http.StatusInternalServerError, &calls),
+    WithHandlerBreakerOptions(WithClock(clk), WithFailuresThreshold(2), WithOpenDuration(5*time.Second)))
+
+  assert.Equal(t, http.StatusInternalServerError, serve(h, "/").Code)
+  assert.Equal(t, http.StatusInternalServerError, serve(h, "/").Code)
+
+  rec := serve(h, "/")
+  assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+  assert.Equal(t, "5", rec.Header().Get("Retry-After"))
+  assert.Equal(t, "api", rec.Header().Get(HeaderCircuitBreaker))
+  assert.Equal(t, 2, calls, "the handler should not be called when the circuit is open")
+}
+
+func TestHttpHandlerShouldRejectWhenAFallbackReplacesTheRejection(t *testing.T) {
+  var calls int
+  h := NewHttpHandler("api", statusHandler(http.StatusOK, &calls),
+    WithHandlerBreakerOptions(WithFallback(func(err error) error { return nil })))
+  h.Circuit.ForceOpen()
+
+  rec := serve(h, "/")
+  assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+  assert.Equal(t, 0, calls)
+}
+
+func TestHttpHandlerShouldCountClientErrorsAsSuccesses(t *testing.T) {
+  var calls int
+  h := NewHttpHandler("api", statusHandler(http.StatusNotFound, &calls),
+    WithHandlerBreakerOptions(WithFailuresThreshold(1)))
+
+  for i := 0; i < 3; i++ {
+    assert.Equal(t, http.StatusNotFound, serve(h, "/").Code)
+  }
+  assert.Equal(t, Closed, h.Circuit.State())
+}
+
+func TestHttpHandlerWithStatusClassifier(t *testing.T) {
+  var calls int
+  h := NewHttpHandler("api", statusHandler(http.StatusTooManyRequests, &calls),
+    WithHandlerBreakerOptions(WithFailuresThreshold(1)),
+    WithStatusClassifier(func(status int) bool {
+      return status == http.StatusTooManyRequests
+    }))
+
+  serve(h, "/")
+  assert.Equal(t, Open, h.Circuit.State())
+}
+
+func TestHttpHandlerShouldCountTheImplicitStatus(t *testing.T) {
+  h := NewHttpHandler("api", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    io.WriteString(w, "ok")
+    // ignored by net/http, the status is already 200
+    w.WriteHeader(http.StatusInternalServerError)
+  }), WithHandlerBreakerOptions(WithFailuresThreshold(1)))
+
+  assert.Equal(t, http.StatusOK, serve(h, "/").Code)
+  assert.Equal(t, Closed, h.Circuit.State())
+}
+
+func TestHttpHandlerPerRoute(t *testing.T) {
+  h := NewHttpHandler("api", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if strings.HasPrefix(r.URL.Path, "/orders") {
+      w.WriteHeader(http.StatusBadGateway)
+    }
+  }),
+    WithHandlerBreakerOptions(WithFailuresThreshold(1)),
+    WithRoutes(func(r *http.Request) string {
+      return strings.Split(r.URL.Path, "/")[1]
+    }, 100, 0))
+  defer h.Routes.Close()
+  col := NewHttpHandlerPromCollector(h)
+
+  serve(h, "/orders/1")
+  assert.Equal(t, http.StatusServiceUnavailable, serve(h, "/orders/2").Code)
+  assert.Equal(t, "api/orders", serve(h, "/orders/2").Header().Get(HeaderCircuitBreaker))
+  assert.Equal(t, http.StatusOK, serve(h, "/users/1").Code)
+
+  expected := `
+# HELP circuit_breaker_open_state A counter indicating the number of times the circuit has been in the open state
+# TYPE circuit_breaker_open_state counter
+circuit_breaker_open_state{circuit_breaker_key="orders",circuit_breaker_name="api"} 1
+circuit_breaker_open_state{circuit_breaker_key="users",circuit_breaker_name="api"} 0
+`
+  assert.Nil(t, testutil.CollectAndCompare(col, strings.NewReader(expected), "circuit_breaker_open_state"))
+}
+
+func TestHttpHandlerShouldAnswer500OnPanic(t *testing.T) {
+  h := NewHttpHandler("api", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    panic("boom")
+  }), WithHandlerBreakerOptions(WithFailuresThreshold(1), WithPanicRecovery(false)))
+
+  rec := serve(h, "/")
+  assert.Equal(t, http.StatusInternalServerError, rec.Code)
+  assert.NotContains(t, rec.Body.String(), "boom")
+  assert.Equal(t, Open, h.Circuit.State())
+}
+
+func TestHttpHandlerShouldPreserveFlusher(t *testing.T) {
+  h := NewHttpHandler("api", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    _, isHijacker := w.(http.Hijacker)
+    assert.False(t, isHijacker, "the recorder is not a hijacker")
+
+    flusher, ok := w.(http.Flusher)
+    if assert.True(t, ok) {
+      io.WriteString(w, "chunk")
+      flusher.Flush()
+    }
+  }))
+
+  rec := serve(h, "/")
+  assert.True(t, rec.Flushed)
+  assert.Equal(t, "chunk", rec.Body.String())
+}
+
+func TestHttpHandlerShouldPreserveHijacker(t *testing.T) {
+  h := NewHttpHandler("api", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    _, isFlusher := w.(http.Flusher)
+    assert.True(t, isFlusher)
+
+    conn, rw, err := w.(http.Hijacker).Hijack()
+    if assert.NoError(t, err) {
+      rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+      rw.Flush()
+      conn.Close()
+    }
+  }), WithHandlerBreakerOptions(WithFailuresThreshold(1)))
+  srv := httptest.NewServer(h)
+  defer srv.Close()
+
+  res, err := http.Get(srv.URL)
+  if assert.NoError(t, err) {
+    body, _ := io.ReadAll(res.Body)
+    res.Body.Close()
+    assert.Equal(t, "hijacked", string(body))
+  }
+  assert.Equal(t, Closed, h.Circuit.State())
+}
+
+func TestHttpMiddleware(t *testing.T) {
+  var calls int
+  h := HttpMiddleware("api", WithHandlerBreakerOptions(WithFailuresThreshold(1)))(statusHandler(http.StatusServiceUnavailable, &calls))
+
+  serve(h, "/")
+  serve(h, "/")
+  assert.Equal(t, 1, calls)
+}
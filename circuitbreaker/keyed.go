@@ -0,0 +1,207 @@
+package circuitbreaker
+
+import (
+  "container/list"
+  "context"
+  "sync"
+  "time"
+)
+
+// KeyedCircuitBreaker keeps one circuit breaker per key (a tenant, a host, a shard...), so
+// that a key failing does not open the circuit for the others. The circuit breakers are
+// created on the first call for their key, and closed once evicted and no longer in use.
+type KeyedCircuitBreaker struct {
+  name     string
+  opts     []Options
+  maxKeys  int
+  ttl      time.Duration
+  lock     sync.Mutex
+  keys     map[string]*list.Element
+  lru      *list.List // of *keyedEntry, the most recently used first
+  onCreate []func(key string, cb *CircuitBreaker)
+  onRemove []func(key string, cb *CircuitBreaker)
+}
+
+type keyedEntry struct {
+  key      string
+  cb       *CircuitBreaker
+  lastUsed time.Time
+  // the number of calls using the circuit breaker, which is closed once the
+  // entry is evicted and no call uses it anymore
+  refs    int
+  evicted bool
+}
+
+// NewKeyedCircuitBreaker creates a KeyedCircuitBreaker whose circuit breakers are created with
+// `opts` and named `name/key`. At most `maxKeys` circuit breakers are kept, the least recently
+// used one being evicted when a new key is added, and the keys not used during `ttl` are evicted.
+// A maxKeys or a ttl of 0 means no limit. The eviction is done during the calls, there is no
+// background goroutine involved.
+func NewKeyedCircuitBreaker(name string, maxKeys int, ttl time.Duration, opts ...Options) *KeyedCircuitBreaker {
+  return &KeyedCircuitBreaker{
+    name:    name,
+    opts:    opts,
+    maxKeys: maxKeys,
+    ttl:     ttl,
+    keys:    map[string]*list.Element{},
+    lru:     list.New(),
+  }
+}
+
+// Do calls `op` through the circuit breaker of `key`.
+func (k *KeyedCircuitBreaker) Do(key string, op Op) error {
+  e := k.acquire(key)
+  defer k.release(e)
+  return e.cb.Do(op)
+}
+
+// DoContext calls `op` through the circuit breaker of `key`, see CircuitBreaker.DoContext.
+func (k *KeyedCircuitBreaker) DoContext(ctx context.Context, key string, op OpContext) error {
+  e := k.acquire(key)
+  defer k.release(e)
+  return e.cb.DoContext(ctx, op)
+}
+
+// Get returns the circuit breaker of `key`, creating it if needed. The circuit breaker is
+// closed as soon as it is evicted, so the calls should go through Do, DoContext or Acquire.
+func (k *KeyedCircuitBreaker) Get(key string) *CircuitBreaker {
+  e := k.acquire(key)
+  k.release(e)
+  return e.cb
+}
+
+// Acquire returns the circuit breaker of `key`, creating it if needed, and a function to call
+// once done with it. The circuit breaker is not closed until then, even if it is evicted.
+func (k *KeyedCircuitBreaker) Acquire(key string) (cb *CircuitBreaker, release func()) {
+  e := k.acquire(key)
+  return e.cb, func() {
+    k.release(e)
+  }
+}
+
+func (k *KeyedCircuitBreaker) acquire(key string) *keyedEntry {
+  k.lock.Lock()
+  el, ok := k.keys[key]
+  if ok {
+    k.lru.MoveToFront(el)
+  } else {
+    cb := NewCircuitBreaker(k.name+"/"+key, k.opts...)
+    el = k.lru.PushFront(&keyedEntry{key: key, cb: cb})
+    k.keys[key] = el
+    for _, f := range k.onCreate {
+      f(key, cb)
+    }
+  }
+
+  e := el.Value.(*keyedEntry)
+  e.refs++
+  e.lastUsed = e.cb.clock.Now()
+  evicted := k.evict(e.lastUsed)
+  k.lock.Unlock()
+
+  // closing a circuit breaker runs its hooks, which is better done without holding the lock
+  for _, cb := range evicted {
+    cb.Close()
+  }
+  return e
+}
+
+// release closes the circuit breaker of the entry if it was evicted while in use
+func (k *KeyedCircuitBreaker) release(e *keyedEntry) {
+  if e == nil {
+    return
+  }
+  k.lock.Lock()
+  e.refs--
+  unused := e.evicted && e.refs == 0
+  k.lock.Unlock()
+
+  if unused {
+    e.cb.Close()
+  }
+}
+
+// evict removes the least recently used keys above maxKeys and the keys that expired.
+// The key used last is at the front of the list, so it is never evicted.
+func (k *KeyedCircuitBreaker) evict(now time.Time) (evicted []*CircuitBreaker) {
+  for {
+    el := k.lru.Back()
+    e := el.Value.(*keyedEntry)
+    tooMany := k.maxKeys > 0 && k.lru.Len() > k.maxKeys
+    expired := k.ttl > 0 && now.Sub(e.lastUsed) > k.ttl
+    if !tooMany && !expired {
+      return
+    }
+    if cb := k.remove(el); cb != nil {
+      evicted = append(evicted, cb)
+    }
+  }
+}
+
+// remove evicts the entry, and returns its circuit breaker if it has to be closed now,
+// otherwise it is closed by the last call using it
+func (k *KeyedCircuitBreaker) remove(el *list.Element) *CircuitBreaker {
+  e := k.lru.Remove(el).(*keyedEntry)
+  delete(k.keys, e.key)
+  for _, f := range k.onRemove {
+    f(e.key, e.cb)
+  }
+  if e.refs > 0 {
+    e.evicted = true
+    return nil
+  }
+  return e.cb
+}
+
+// Remove evicts the circuit breaker of `key`. It returns false if there was no such key.
+func (k *KeyedCircuitBreaker) Remove(key string) bool {
+  k.lock.Lock()
+  el, ok := k.keys[key]
+  var cb *CircuitBreaker
+  if ok {
+    cb = k.remove(el)
+  }
+  k.lock.Unlock()
+
+  if cb != nil {
+    cb.Close()
+  }
+  return ok
+}
+
+// Len returns the number of keys that currently have a circuit breaker.
+func (k *KeyedCircuitBreaker) Len() int {
+  k.lock.Lock()
+  defer k.lock.Unlock()
+  return k.lru.Len()
+}
+
+// Close evicts all the keys. The KeyedCircuitBreaker can still be used afterwards.
+func (k *KeyedCircuitBreaker) Close() {
+  k.lock.Lock()
+  var evicted []*CircuitBreaker
+  for el := k.lru.Back(); el != nil; el = k.lru.Back() {
+    if cb := k.remove(el); cb != nil {
+      evicted = append(evicted, cb)
+    }
+  }
+  k.lock.Unlock()
+
+  for _, cb := range evicted {
+    cb.Close()
+  }
+}
+
+// observe calls onCreate for the existing circuit breakers and for each new one,
+// and onRemove each time a circuit breaker is evicted
+func (k *KeyedCircuitBreaker) observe(onCreate, onRemove func(key string, cb *CircuitBreaker)) {
+  k.lock.Lock()
+  defer k.lock.Unlock()
+
+  for el := k.lru.Front(); el != nil; el = el.Next() {
+    e := el.Value.(*keyedEntry)
+    onCreate(e.key, e.cb)
+  }
+  k.onCreate = append(k.onCreate, onCreate)
+  k.onRemove = append(k.onRemove, onRemove)
+}
@@ -0,0 +1,187 @@
+package circuitbreaker
+
+import (
+  "context"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/ocampeau/gutils/circuitbreaker/clock"
+  "github.com/ocampeau/gutils/circuitbreaker/strategy"
+  "github.com/prometheus/client_golang/prometheus/testutil"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestKeyedCircuitBreakerShouldIsolateTheKeys(t *testing.T) {
+  k := NewKeyedCircuitBreaker("tenants", 0, 0, WithFailuresThreshold(1))
+  defer k.Close()
+
+  k.Do("noisy", func() error { return ErrCircuitInternal })
+
+  assert.Equal(t, ErrCircuitOpen, k.Do("noisy", func() error { return nil }))
+  assert.Nil(t, k.Do("quiet", func() error { return nil }))
+  assert.Equal(t, "tenants/noisy", k.Get("noisy").Name())
+  assert.Equal(t, 2, k.Len())
+}
+
+func TestKeyedCircuitBreakerShouldCreateOneStrategyPerKey(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  k := NewKeyedCircuitBreaker("tenants", 0, 0,
+    WithClock(clk),
+    WithFailuresThreshold(1),
+    WithOpenDuration(time.Second),
+    WithCustomStrategyFactory(func(clk clock.Clock) strategy.Strategy {
+      return strategy.NewTimerStrategy(time.Second, 2, strategy.WithClock(clk))
+    }))
+  defer k.Close()
+  a, b := k.Get("a"), k.Get("b")
+  a.Do(func() error { return ErrCircuitInternal })
+  b.Do(func() error { return ErrCircuitInternal })
+  clk.Advance(time.Second)
+  assert.Equal(t, HalfOpen, a.State())
+  assert.Equal(t, HalfOpen, b.State())
+
+  // each key admits its own probe
+  op := func(ctx context.Context) error { return nil }
+  doneA, err := a.DoDeferred(context.Background(), op)
+  assert.NoError(t, err)
+  doneB, err := b.DoDeferred(context.Background(), op)
+  assert.NoError(t, err, "the probe of a should not hold the probe of b")
+  doneA(nil)
+  doneB(nil)
+
+  // the successes of a do not close b
+  clk.Advance(time.Second)
+  assert.NoError(t, a.Do(func() error { return nil }))
+  assert.Equal(t, Closed, a.State())
+  assert.Equal(t, HalfOpen, b.State())
+}
+
+func TestKeyedCircuitBreakerShouldEvictTheLeastRecentlyUsedKey(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  k := NewKeyedCircuitBreaker("tenants", 2, 0, WithClock(clk), WithFailuresThreshold(1))
+
+  a := k.Get("a")
+  a.Do(func() error { return ErrCircuitInternal })
+  assert.Equal(t, 1, clk.Timers())
+  b := k.Get("b")
+  k.Get("a")
+  k.Get("c")
+
+  assert.Equal(t, 2, k.Len())
+  assert.Equal(t, Stopped, b.State(), "b was the least recently used key")
+  assert.Same(t, a, k.Get("a"))
+  assert.NotSame(t, b, k.Get("b"))
+  k.Get("c")
+
+  assert.Equal(t, Stopped, a.State(), "a was evicted by c")
+  assert.Equal(t, 0, clk.Timers(), "the open timer of an evicted breaker should be canceled")
+}
+
+func TestKeyedCircuitBreakerShouldEvictTheExpiredKeys(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  k := NewKeyedCircuitBreaker("tenants", 0, time.Minute, WithClock(clk))
+
+  a := k.Get("a")
+  clk.Advance(30 * time.Second)
+  b := k.Get("b")
+  clk.Advance(31 * time.Second)
+  k.Get("c")
+
+  assert.Equal(t, 2, k.Len())
+  assert.Equal(t, Stopped, a.State())
+  assert.Equal(t, Closed, b.State())
+
+  assert.True(t, k.Remove("b"))
+  assert.False(t, k.Remove("b"))
+  assert.Equal(t, Stopped, b.State())
+}
+
+func TestKeyedCircuitBreakerConcurrent(t *testing.T) {
+  k := NewKeyedCircuitBreaker("tenants", 3, 0)
+  defer k.Close()
+
+  wg := sync.WaitGroup{}
+  for i := 0; i < 8; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      for j := 0; j < 100; j++ {
+        k.Do(string(rune('a'+(i+j)%5)), func() error { return nil })
+      }
+    }(i)
+  }
+  wg.Wait()
+
+  assert.Equal(t, 3, k.Len())
+}
+
+func TestKeyedCircuitBreakerShouldNotCloseTheBreakersInUseConcurrent(t *testing.T) {
+  k := NewKeyedCircuitBreaker("tenants", 1, 0)
+  defer k.Close()
+
+  var numStopped uint32
+  wg := sync.WaitGroup{}
+  for i := 0; i < 8; i++ {
+    wg.Add(1)
+    go func(key string) {
+      defer wg.Done()
+      for j := 0; j < 1000; j++ {
+        // every call evicts the key of another goroutine, maybe while it is in use
+        if k.Do(key, func() error { return nil }) == ErrCircuitStopped {
+          atomic.AddUint32(&numStopped, 1)
+        }
+      }
+    }(string(rune('a' + i)))
+  }
+  wg.Wait()
+
+  assert.Equal(t, uint32(0), numStopped)
+}
+
+func TestKeyedCircuitBreakerShouldCloseTheEvictedBreakerOnceReleased(t *testing.T) {
+  k := NewKeyedCircuitBreaker("tenants", 1, 0)
+  defer k.Close()
+
+  a, release := k.Acquire("a")
+  k.Do("b", func() error { return nil })
+  assert.Equal(t, 1, k.Len())
+  assert.Equal(t, Closed, a.State(), "a breaker in use should not be closed")
+
+  release()
+  assert.Equal(t, Stopped, a.State())
+
+  // a breaker that is not in use is closed right away
+  b := k.Get("b")
+  k.Remove("b")
+  assert.Equal(t, Stopped, b.State())
+}
+
+func TestKeyedPromCollectorShouldRemoveTheEvictedKeys(t *testing.T) {
+  k := NewKeyedCircuitBreaker("tenants", 1, 0, WithFailuresThreshold(1))
+  col := NewKeyedPromCollector(k)
+
+  a := k.Get("a")
+  a.Do(func() error { return ErrCircuitInternal })
+
+  expected := `
+# HELP circuit_breaker_open_state A counter indicating the number of times the circuit has been in the open state
+# TYPE circuit_breaker_open_state counter
+circuit_breaker_open_state{circuit_breaker_key="a",circuit_breaker_name="tenants"} 1
+`
+  assert.Nil(t, testutil.CollectAndCompare(col, strings.NewReader(expected), "circuit_breaker_open_state"))
+
+  k.Get("b")
+  expected = `
+# HELP circuit_breaker_open_state A counter indicating the number of times the circuit has been in the open state
+# TYPE circuit_breaker_open_state counter
+circuit_breaker_open_state{circuit_breaker_key="b",circuit_breaker_name="tenants"} 0
+`
+  assert.Nil(t, testutil.CollectAndCompare(col, strings.NewReader(expected), "circuit_breaker_open_state"))
+  assert.Empty(t, a.listeners.load(), "the collector should not keep hooks on an evicted breaker")
+
+  k.Close()
+  assert.Equal(t, 0, testutil.CollectAndCount(col))
+}
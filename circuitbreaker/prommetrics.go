@@ -1,6 +1,7 @@
 package circuitbreaker
 
 import (
+  "sync"
   "sync/atomic"
 
   "github.com/prometheus/client_golang/prometheus"
@@ -8,65 +9,176 @@ import (
 
 const (
   LabelsCircuitBreakerName = "circuit_breaker_name"
+  LabelsCircuitBreakerKey  = "circuit_breaker_key"
 )
 
+// PromCollector exports the metrics of one or many circuit breakers. Each circuit breaker
+// has its own series, identified by its name and its key, which is empty when the circuit
+// breaker is not part of a KeyedCircuitBreaker. All the collectors have the same labels,
+// so that they can be registered together. The collectors of many circuit breakers are
+// unchecked, since their circuit breakers come and go and can't be described upfront.
 type PromCollector struct {
-  cb                    *CircuitBreaker
-  didOpen               uint64
-  didClose              uint64
-  didHalfOpen           uint64
+  lock                  sync.RWMutex
+  breakers              map[*CircuitBreaker]*breakerMetrics
+  unchecked             bool
   descCbOpenCounter     *prometheus.Desc
   descCbHalfOpenCounter *prometheus.Desc
   descCbCloseCounter    *prometheus.Desc
+  descCbFallbackCounter *prometheus.Desc
   descCbState           *prometheus.Desc
+  descCbOpenDuration    *prometheus.Desc
+}
+
+type breakerMetrics struct {
+  didOpen     uint64
+  didClose    uint64
+  didHalfOpen uint64
+  didFallback uint64
+  labels      []string
+  unsubscribe []func()
 }
 
 func NewPromCollector(cb *CircuitBreaker) prometheus.Collector {
-  col := &PromCollector{
+  col := newPromCollector(prometheus.Labels{LabelsCircuitBreakerName: cb.name, LabelsCircuitBreakerKey: ""})
+  col.add(cb)
+  return col
+}
+
+// NewRegistryPromCollector exports the metrics of all the circuit breakers of the registry,
+// including the ones created after the collector.
+func NewRegistryPromCollector(r *Registry) prometheus.Collector {
+  col := newPromCollector(nil, LabelsCircuitBreakerName, LabelsCircuitBreakerKey)
+  r.observe(func(cb *CircuitBreaker) {
+    col.add(cb, cb.name, "")
+  }, col.remove)
+  return col
+}
+
+// NewKeyedPromCollector exports the metrics of the circuit breakers of a KeyedCircuitBreaker,
+// with the key as a label. The series of a key are removed once it is evicted.
+func NewKeyedPromCollector(k *KeyedCircuitBreaker) prometheus.Collector {
+  col := newPromCollector(nil, LabelsCircuitBreakerName, LabelsCircuitBreakerKey)
+  k.observe(func(key string, cb *CircuitBreaker) {
+    col.add(cb, k.name, key)
+  }, func(_ string, cb *CircuitBreaker) {
+    col.remove(cb)
+  })
+  return col
+}
+
+// NewHttpTransportPromCollector exports the metrics of the circuit breakers of the transport.
+// In per-host mode, the host is exported as the key.
+func NewHttpTransportPromCollector(t *HttpTransport) prometheus.Collector {
+  if t.Hosts != nil {
+    return NewKeyedPromCollector(t.Hosts)
+  }
+  return NewPromCollector(t.Circuit)
+}
+
+// NewHttpHandlerPromCollector exports the metrics of the circuit breakers of the handler.
+// In per-route mode, the route is exported as the key.
+func NewHttpHandlerPromCollector(h *HttpHandler) prometheus.Collector {
+  if h.Routes != nil {
+    return NewKeyedPromCollector(h.Routes)
+  }
+  return NewPromCollector(h.Circuit)
+}
+
+// newPromCollector creates a collector whose labels are the constant labels
+// and the variable labels given to add
+func newPromCollector(constLabels prometheus.Labels, labels ...string) *PromCollector {
+  return &PromCollector{
+    breakers:  map[*CircuitBreaker]*breakerMetrics{},
+    unchecked: len(labels) > 0,
     descCbOpenCounter: prometheus.NewDesc("circuit_breaker_open_state",
       "A counter indicating the number of times the circuit has been in the open state",
-      nil, prometheus.Labels{LabelsCircuitBreakerName: cb.name}),
+      labels, constLabels),
     descCbCloseCounter: prometheus.NewDesc("circuit_breaker_close_state",
       "A counter indicating the number of times the circuit has been in the close state",
-      nil, prometheus.Labels{LabelsCircuitBreakerName: cb.name}),
+      labels, constLabels),
     descCbHalfOpenCounter: prometheus.NewDesc("circuit_breaker_halfopen_state",
       "A counter indicating the number of times the circuit has been in the half-open state",
-      nil, prometheus.Labels{LabelsCircuitBreakerName: cb.name}),
+      labels, constLabels),
+    descCbFallbackCounter: prometheus.NewDesc("circuit_breaker_fallback",
+      "A counter indicating the number of times a fallback has been called",
+      labels, constLabels),
     descCbState: prometheus.NewDesc("circuit_breaker_current_state",
-      "A gauge that indicates the current state of the circuit",
-      nil, prometheus.Labels{LabelsCircuitBreakerName: cb.name}),
+      "A gauge that indicates the current state of the circuit "+
+        "(0: closed, 1: open, 2: half-open, 3: forced open, 4: forced closed, 5: disabled, 6: stopped)",
+      labels, constLabels),
+    descCbOpenDuration: prometheus.NewDesc("circuit_breaker_open_duration_seconds",
+      "A gauge that indicates how long the circuit stays open during the current or last open period",
+      labels, constLabels),
   }
+}
 
-  cb.RegisterOnHalfOpenHooks(col.circuitBreakerHalfOpen)
-  cb.RegisterOnCloseHooks(col.circuitBreakerClose)
-  cb.RegisterOnOpenHooks(col.circuitBreakerOpen)
+// add starts exporting the metrics of the circuit breaker, with the given label values
+func (col *PromCollector) add(cb *CircuitBreaker, labelValues ...string) {
+  m := &breakerMetrics{labels: labelValues}
+  m.unsubscribe = []func(){
+    cb.RegisterOnHalfOpenHooks(m.circuitBreakerHalfOpen),
+    cb.RegisterOnCloseHooks(m.circuitBreakerClose),
+    cb.RegisterOnOpenHooks(m.circuitBreakerOpen),
+    cb.RegisterOnFallbackHooks(m.circuitBreakerFallback),
+  }
 
-  col.cb = cb
-  return col
+  col.lock.Lock()
+  col.breakers[cb] = m
+  col.lock.Unlock()
+}
+
+// remove deletes the series of the circuit breaker
+func (col *PromCollector) remove(cb *CircuitBreaker) {
+  col.lock.Lock()
+  m, ok := col.breakers[cb]
+  delete(col.breakers, cb)
+  col.lock.Unlock()
+
+  if ok {
+    for _, unsubscribe := range m.unsubscribe {
+      unsubscribe()
+    }
+  }
+}
+
+func (m *breakerMetrics) circuitBreakerOpen() {
+  atomic.AddUint64(&m.didOpen, 1)
 }
 
-func (col *PromCollector) circuitBreakerOpen() {
-  atomic.AddUint64(&col.didOpen, 1)
+func (m *breakerMetrics) circuitBreakerClose() {
+  atomic.AddUint64(&m.didClose, 1)
 }
 
-func (col *PromCollector) circuitBreakerClose() {
-  atomic.AddUint64(&col.didClose, 1)
+func (m *breakerMetrics) circuitBreakerHalfOpen() {
+  atomic.AddUint64(&m.didHalfOpen, 1)
 }
 
-func (col *PromCollector) circuitBreakerHalfOpen() {
-  atomic.AddUint64(&col.didHalfOpen, 1)
+func (m *breakerMetrics) circuitBreakerFallback(_ error) {
+  atomic.AddUint64(&m.didFallback, 1)
 }
 
 func (col *PromCollector) Describe(ch chan<- *prometheus.Desc) {
+  if col.unchecked {
+    return
+  }
   ch <- col.descCbCloseCounter
   ch <- col.descCbOpenCounter
   ch <- col.descCbHalfOpenCounter
+  ch <- col.descCbFallbackCounter
   ch <- col.descCbState
+  ch <- col.descCbOpenDuration
 }
 
 func (col *PromCollector) Collect(ch chan<- prometheus.Metric) {
-  ch <- prometheus.MustNewConstMetric(col.descCbCloseCounter, prometheus.CounterValue, float64(col.didClose))
-  ch <- prometheus.MustNewConstMetric(col.descCbOpenCounter, prometheus.CounterValue, float64(col.didOpen))
-  ch <- prometheus.MustNewConstMetric(col.descCbHalfOpenCounter, prometheus.CounterValue, float64(col.didHalfOpen))
-  ch <- prometheus.MustNewConstMetric(col.descCbState, prometheus.GaugeValue, float64(col.cb.state))
+  col.lock.RLock()
+  defer col.lock.RUnlock()
+
+  for cb, m := range col.breakers {
+    ch <- prometheus.MustNewConstMetric(col.descCbCloseCounter, prometheus.CounterValue, float64(atomic.LoadUint64(&m.didClose)), m.labels...)
+    ch <- prometheus.MustNewConstMetric(col.descCbOpenCounter, prometheus.CounterValue, float64(atomic.LoadUint64(&m.didOpen)), m.labels...)
+    ch <- prometheus.MustNewConstMetric(col.descCbHalfOpenCounter, prometheus.CounterValue, float64(atomic.LoadUint64(&m.didHalfOpen)), m.labels...)
+    ch <- prometheus.MustNewConstMetric(col.descCbFallbackCounter, prometheus.CounterValue, float64(atomic.LoadUint64(&m.didFallback)), m.labels...)
+    ch <- prometheus.MustNewConstMetric(col.descCbState, prometheus.GaugeValue, cb.loadState().metricValue(), m.labels...)
+    ch <- prometheus.MustNewConstMetric(col.descCbOpenDuration, prometheus.GaugeValue, cb.OpenDuration().Seconds(), m.labels...)
+  }
 }
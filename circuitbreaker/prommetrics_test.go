@@ -0,0 +1,66 @@
+package circuitbreaker
+
+import (
+  "net/http"
+  "strings"
+  "testing"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/testutil"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestPromCollectorShouldCountFallbacks(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFallback(func(err error) error {
+    return nil
+  }))
+  col := NewPromCollector(cb)
+
+  cb.state = Open
+  cb.Do(func() error { return nil })
+  cb.Do(func() error { return nil })
+
+  expected := `
+# HELP circuit_breaker_fallback A counter indicating the number of times a fallback has been called
+# TYPE circuit_breaker_fallback counter
+circuit_breaker_fallback{circuit_breaker_key="",circuit_breaker_name="test"} 2
+`
+  assert.Nil(t, testutil.CollectAndCompare(col, strings.NewReader(expected), "circuit_breaker_fallback"))
+}
+
+func TestPromCollectorShouldExportTheStateValue(t *testing.T) {
+  cb := NewCircuitBreaker("test")
+  col := NewPromCollector(cb)
+
+  cb.openCircuit(Closed, nil)
+
+  expected := `
+# HELP circuit_breaker_current_state A gauge that indicates the current state of the circuit (0: closed, 1: open, 2: half-open, 3: forced open, 4: forced closed, 5: disabled, 6: stopped)
+# TYPE circuit_breaker_current_state gauge
+circuit_breaker_current_state{circuit_breaker_key="",circuit_breaker_name="test"} 1
+`
+  assert.Nil(t, testutil.CollectAndCompare(col, strings.NewReader(expected), "circuit_breaker_current_state"))
+  cb.Close()
+}
+
+func TestPromCollectorsShouldBeRegisteredTogether(t *testing.T) {
+  reg := prometheus.NewPedanticRegistry()
+  tenants := NewKeyedCircuitBreaker("tenants", 0, 0)
+  defer tenants.Close()
+  tenants.Do("acme", func() error { return nil })
+
+  assert.NoError(t, reg.Register(NewPromCollector(NewCircuitBreaker("users"))))
+  assert.NoError(t, reg.Register(NewPromCollector(NewCircuitBreaker("orders"))))
+  assert.NoError(t, reg.Register(NewKeyedPromCollector(tenants)))
+  assert.NoError(t, reg.Register(NewHttpTransportPromCollector(NewHttpTransport("backend", nil, WithPerHost(10, 0)))))
+  assert.NoError(t, reg.Register(NewHttpHandlerPromCollector(NewHttpHandler("api", nil, WithRoutes(func(r *http.Request) string { return r.URL.Path }, 10, 0)))))
+
+  expected := `
+# HELP circuit_breaker_open_state A counter indicating the number of times the circuit has been in the open state
+# TYPE circuit_breaker_open_state counter
+circuit_breaker_open_state{circuit_breaker_key="",circuit_breaker_name="orders"} 0
+circuit_breaker_open_state{circuit_breaker_key="",circuit_breaker_name="users"} 0
+circuit_breaker_open_state{circuit_breaker_key="acme",circuit_breaker_name="tenants"} 0
+`
+  assert.Nil(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "circuit_breaker_open_state"))
+}
@@ -0,0 +1,118 @@
+package circuitbreaker
+
+import (
+  "sort"
+  "sync"
+)
+
+// Registry keeps the circuit breakers of an application by name, so they can be looked up
+// instead of being passed around.
+type Registry struct {
+  lock      sync.RWMutex
+  breakers  map[string]*CircuitBreaker
+  defaults  []Options
+  listeners hookList[Listener]
+  onCreate  []func(cb *CircuitBreaker)
+  onRemove  []func(cb *CircuitBreaker)
+}
+
+// NewRegistry creates an empty registry. The `defaults` options are applied to every circuit
+// breaker created by the registry, before the options given to GetOrCreate.
+func NewRegistry(defaults ...Options) *Registry {
+  return &Registry{
+    breakers: map[string]*CircuitBreaker{},
+    defaults: defaults,
+  }
+}
+
+// GetOrCreate returns the circuit breaker named `name`, or creates it if it does not exist.
+// The options are ignored when the circuit breaker already exists.
+func (r *Registry) GetOrCreate(name string, opts ...Options) *CircuitBreaker {
+  if cb, ok := r.Get(name); ok {
+    return cb
+  }
+
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  if cb, ok := r.breakers[name]; ok {
+    return cb
+  }
+
+  all := make([]Options, 0, len(r.defaults)+len(opts))
+  all = append(all, r.defaults...)
+  all = append(all, opts...)
+  cb := NewCircuitBreaker(name, all...)
+  cb.RegisterListener(r.emit)
+
+  r.breakers[name] = cb
+  for _, f := range r.onCreate {
+    f(cb)
+  }
+  return cb
+}
+
+func (r *Registry) Get(name string) (*CircuitBreaker, bool) {
+  r.lock.RLock()
+  defer r.lock.RUnlock()
+  cb, ok := r.breakers[name]
+  return cb, ok
+}
+
+// All returns the circuit breakers of the registry, sorted by name.
+func (r *Registry) All() []*CircuitBreaker {
+  r.lock.RLock()
+  all := make([]*CircuitBreaker, 0, len(r.breakers))
+  for _, cb := range r.breakers {
+    all = append(all, cb)
+  }
+  r.lock.RUnlock()
+
+  sort.Slice(all, func(i, j int) bool {
+    return all[i].name < all[j].name
+  })
+  return all
+}
+
+// Remove removes the circuit breaker named `name` from the registry and closes it.
+// It returns false if there was no such circuit breaker.
+func (r *Registry) Remove(name string) bool {
+  r.lock.Lock()
+  cb, ok := r.breakers[name]
+  if ok {
+    delete(r.breakers, name)
+    for _, f := range r.onRemove {
+      f(cb)
+    }
+  }
+  r.lock.Unlock()
+
+  if ok {
+    cb.Close()
+  }
+  return ok
+}
+
+// RegisterListener registers a function called each time the state of any circuit
+// breaker of the registry changes.
+func (r *Registry) RegisterListener(l Listener) (unsubscribe func()) {
+  return r.listeners.add(l)
+}
+
+func (r *Registry) emit(event StateChangeEvent) {
+  for _, l := range r.listeners.load() {
+    (*l)(event)
+  }
+}
+
+// observe calls onCreate for the existing circuit breakers and for each new one,
+// and onRemove each time a circuit breaker is removed
+func (r *Registry) observe(onCreate, onRemove func(cb *CircuitBreaker)) {
+  r.lock.Lock()
+  defer r.lock.Unlock()
+
+  for _, cb := range r.breakers {
+    onCreate(cb)
+  }
+  r.onCreate = append(r.onCreate, onCreate)
+  r.onRemove = append(r.onRemove, onRemove)
+}
@@ -0,0 +1,111 @@
+package circuitbreaker
+
+import (
+  "strings"
+  "sync"
+  "testing"
+
+  "github.com/prometheus/client_golang/prometheus/testutil"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestRegistryGetOrCreateShouldReturnTheSameBreaker(t *testing.T) {
+  r := NewRegistry(WithFailuresThreshold(10))
+
+  cb := r.GetOrCreate("users", WithFailuresThreshold(2))
+  assert.Equal(t, "users", cb.Name())
+  assert.Equal(t, uint32(2), cb.consecutiveFailuresThreshold, "the options should override the defaults")
+  assert.Same(t, cb, r.GetOrCreate("users", WithFailuresThreshold(5)))
+
+  orders := r.GetOrCreate("orders")
+  assert.Equal(t, uint32(10), orders.consecutiveFailuresThreshold)
+
+  got, ok := r.Get("orders")
+  assert.True(t, ok)
+  assert.Same(t, orders, got)
+  _, ok = r.Get("payments")
+  assert.False(t, ok)
+
+  assert.Equal(t, []*CircuitBreaker{orders, cb}, r.All())
+}
+
+func TestRegistryGetOrCreateConcurrent(t *testing.T) {
+  r := NewRegistry()
+
+  breakers := make([]*CircuitBreaker, 8)
+  wg := sync.WaitGroup{}
+  for i := range breakers {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      breakers[i] = r.GetOrCreate("test")
+    }(i)
+  }
+  wg.Wait()
+
+  for _, cb := range breakers {
+    assert.Same(t, breakers[0], cb)
+  }
+}
+
+func TestRegistryRemoveShouldCloseTheBreaker(t *testing.T) {
+  r := NewRegistry()
+  cb := r.GetOrCreate("test")
+
+  assert.True(t, r.Remove("test"))
+  assert.False(t, r.Remove("test"))
+  assert.Equal(t, Stopped, cb.State())
+  assert.Empty(t, r.All())
+  assert.NotSame(t, cb, r.GetOrCreate("test"))
+}
+
+func TestRegistryListenerShouldReceiveTheEventsOfAllBreakers(t *testing.T) {
+  r := NewRegistry(WithFailuresThreshold(1))
+  users := r.GetOrCreate("users")
+
+  var names []string
+  r.RegisterListener(func(event StateChangeEvent) {
+    if event.To == Open {
+      names = append(names, event.Name)
+    }
+  })
+  orders := r.GetOrCreate("orders")
+
+  users.Do(func() error { return ErrCircuitInternal })
+  orders.Do(func() error { return ErrCircuitInternal })
+  assert.Equal(t, []string{"users", "orders"}, names)
+
+  r.Remove("users")
+  r.Remove("orders")
+}
+
+func TestRegistryPromCollectorShouldExportAllBreakers(t *testing.T) {
+  r := NewRegistry(WithFailuresThreshold(1))
+  users := r.GetOrCreate("users")
+  col := NewRegistryPromCollector(r)
+  orders := r.GetOrCreate("orders")
+
+  users.Do(func() error { return ErrCircuitInternal })
+  orders.Do(func() error { return ErrCircuitInternal })
+
+  expected := `
+# HELP circuit_breaker_open_state A counter indicating the number of times the circuit has been in the open state
+# TYPE circuit_breaker_open_state counter
+circuit_breaker_open_state{circuit_breaker_key="",circuit_breaker_name="orders"} 1
+circuit_breaker_open_state{circuit_breaker_key="",circuit_breaker_name="users"} 1
+`
+  assert.Nil(t, testutil.CollectAndCompare(col, strings.NewReader(expected), "circuit_breaker_open_state"))
+
+  r.Remove("users")
+  expected = `
+# HELP circuit_breaker_open_state A counter indicating the number of times the circuit has been in the open state
+# TYPE circuit_breaker_open_state counter
+circuit_breaker_open_state{circuit_breaker_key="",circuit_breaker_name="orders"} 1
+`
+  assert.Nil(t, testutil.CollectAndCompare(col, strings.NewReader(expected), "circuit_breaker_open_state"))
+  // only the listener of the registry is left
+  assert.Len(t, users.listeners.load(), 1, "the collector should not keep hooks on a removed breaker")
+  assert.Empty(t, users.fallbackHooks.load())
+
+  r.Remove("orders")
+}
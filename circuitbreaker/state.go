@@ -0,0 +1,88 @@
+package circuitbreaker
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+)
+
+// State is the state of a circuit breaker. The values of the states are exported as is by the
+// Prometheus collector, so they are part of the API and never change.
+type State uint32
+
+const (
+  Closed   State = 0
+  Open     State = 1
+  HalfOpen State = 2
+  // the forced states are only entered and left manually
+  ForcedOpen   State = 3
+  ForcedClosed State = 4
+  Disabled     State = 5
+  // the circuit breaker was closed with Close, it never leaves this state
+  Stopped State = 6
+)
+
+var stateNames = [...]string{
+  Closed:       "closed",
+  Open:         "open",
+  HalfOpen:     "half-open",
+  ForcedOpen:   "forced-open",
+  ForcedClosed: "forced-closed",
+  Disabled:     "disabled",
+  Stopped:      "stopped",
+}
+
+// the names returned by CurrentState, accepted by ParseState for compatibility
+var legacyStateNames = map[string]State{
+  "close":        Closed,
+  "halfopen":     HalfOpen,
+  "forcedopen":   ForcedOpen,
+  "forcedclosed": ForcedClosed,
+}
+
+func (s State) String() string {
+  if !s.valid() {
+    return "State(" + strconv.FormatUint(uint64(s), 10) + ")"
+  }
+  return stateNames[s]
+}
+
+func (s State) valid() bool {
+  return int(s) < len(stateNames)
+}
+
+// metricValue is the value of the state exported by the Prometheus collector
+func (s State) metricValue() float64 {
+  return float64(s)
+}
+
+// ParseState returns the state named `name`, as returned by String. The names are case-insensitive.
+func ParseState(name string) (State, error) {
+  name = strings.ToLower(name)
+  for s, n := range stateNames {
+    if n == name {
+      return State(s), nil
+    }
+  }
+  if s, ok := legacyStateNames[name]; ok {
+    return s, nil
+  }
+  return 0, fmt.Errorf("unknown circuit breaker state %q", name)
+}
+
+// MarshalText encodes the state as its name, which is also used by encoding/json.
+func (s State) MarshalText() ([]byte, error) {
+  if !s.valid() {
+    return nil, fmt.Errorf("invalid circuit breaker state %d", uint32(s))
+  }
+  return []byte(stateNames[s]), nil
+}
+
+func (s *State) UnmarshalText(text []byte) error {
+  state, err := ParseState(string(text))
+  if err != nil {
+    return err
+  }
+  *s = state
+  return nil
+}
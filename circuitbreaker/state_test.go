@@ -0,0 +1,62 @@
+package circuitbreaker
+
+import (
+  "encoding/json"
+  "testing"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestStateShouldRoundTripThroughItsName(t *testing.T) {
+  for _, s := range []State{Closed, Open, HalfOpen, ForcedOpen, ForcedClosed, Disabled, Stopped} {
+    parsed, err := ParseState(s.String())
+    assert.NoError(t, err)
+    assert.Equal(t, s, parsed)
+  }
+}
+
+func TestStateValuesShouldNotChange(t *testing.T) {
+  // the values are exported by the Prometheus collector
+  assert.Equal(t, []float64{0, 1, 2, 3, 4, 5, 6}, []float64{
+    Closed.metricValue(),
+    Open.metricValue(),
+    HalfOpen.metricValue(),
+    ForcedOpen.metricValue(),
+    ForcedClosed.metricValue(),
+    Disabled.metricValue(),
+    Stopped.metricValue(),
+  })
+}
+
+func TestParseStateShouldAcceptTheCurrentStateNames(t *testing.T) {
+  cb := NewCircuitBreaker("test")
+  for _, set := range []func(){cb.Reset, cb.ForceOpen, cb.ForceClose, cb.Disable, cb.Close} {
+    set()
+    s, err := ParseState(cb.CurrentState())
+    assert.NoError(t, err)
+    assert.Equal(t, cb.State(), s)
+  }
+
+  s, err := ParseState("Half-Open")
+  assert.NoError(t, err)
+  assert.Equal(t, HalfOpen, s)
+
+  _, err = ParseState("ajar")
+  assert.EqualError(t, err, `unknown circuit breaker state "ajar"`)
+}
+
+func TestStateJSON(t *testing.T) {
+  b, err := json.Marshal(map[string]State{"state": HalfOpen})
+  assert.NoError(t, err)
+  assert.Equal(t, `{"state":"half-open"}`, string(b))
+
+  var decoded struct{ State State }
+  assert.NoError(t, json.Unmarshal([]byte(`{"State":"forced-open"}`), &decoded))
+  assert.Equal(t, ForcedOpen, decoded.State)
+
+  assert.Error(t, json.Unmarshal([]byte(`{"State":"ajar"}`), &decoded))
+
+  _, err = json.Marshal(State(42))
+  assert.Error(t, err)
+  assert.Equal(t, "State(42)", State(42).String())
+}
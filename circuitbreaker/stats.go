@@ -0,0 +1,47 @@
+package circuitbreaker
+
+import (
+  "sync/atomic"
+  "time"
+)
+
+// Stats is a snapshot of the state and the counters of a circuit breaker. The totals count
+// the calls recorded since the circuit breaker was created, the calls ignored by the failure
+// predicate and the calls made in a forced closed or disabled state are not counted.
+type Stats struct {
+  State State
+  // StateSince is the time at which the circuit entered its current state
+  StateSince time.Time
+  // NextTransition is the time at which the circuit goes half-open, it is
+  // the zero time when no transition is scheduled
+  NextTransition       time.Time
+  ConsecutiveFailures  uint32
+  ConsecutiveSuccesses uint32
+  Successes            uint64
+  Failures             uint64
+  Rejections           uint64
+  SlowCalls            uint64
+  Window               WindowStats
+}
+
+// Stats returns a snapshot of the circuit breaker. The fields are read one by one without
+// stopping the calls, so they may not be consistent with each other under load.
+func (c *CircuitBreaker) Stats() Stats {
+  stats := Stats{
+    State:                c.loadState(),
+    StateSince:           time.Unix(0, atomic.LoadInt64(&c.stateSince)),
+    ConsecutiveFailures:  atomic.LoadUint32(&c.consecutiveFailures),
+    ConsecutiveSuccesses: atomic.LoadUint32(&c.consecutiveSuccesses),
+    Successes:            atomic.LoadUint64(&c.totalSuccesses),
+    Failures:             atomic.LoadUint64(&c.totalFailures),
+    Rejections:           atomic.LoadUint64(&c.totalRejections),
+    SlowCalls:            atomic.LoadUint64(&c.totalSlowCalls),
+  }
+  if stats.State == Open {
+    stats.NextTransition = stats.StateSince.Add(c.OpenDuration())
+  }
+  if c.window != nil {
+    stats.Window = newWindowStats(c.window.counts())
+  }
+  return stats
+}
@@ -0,0 +1,83 @@
+package circuitbreaker
+
+import (
+  "errors"
+  "testing"
+  "time"
+
+  "github.com/ocampeau/gutils/circuitbreaker/clock"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestStatsShouldCountTheCalls(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  cb := NewCircuitBreaker("test",
+    WithClock(clk),
+    WithFailuresThreshold(2),
+    WithSlowCallThreshold(time.Second),
+    WithOpenDuration(3*time.Second),
+    WithTimerStrategy(time.Second, 2),
+    WithFailurePredicate(IgnoreErrors(errIgnored)))
+
+  assert.Equal(t, Stats{State: Closed, StateSince: time.Unix(1000, 0)}, cb.Stats())
+
+  cb.Do(func() error { return nil })
+  cb.Do(func() error { return nil })
+  cb.Do(func() error { return errIgnored })
+  cb.Do(func() error { return ErrCircuitInternal })
+  assert.Equal(t, Stats{
+    State:               Closed,
+    StateSince:          time.Unix(1000, 0),
+    ConsecutiveFailures: 1,
+    Successes:           2,
+    Failures:            1,
+  }, cb.Stats())
+
+  clk.Advance(time.Second)
+  cb.Do(slowOp(clk, 2*time.Second))
+  cb.Do(func() error { return nil })
+  cb.Do(func() error { return nil })
+  assert.Equal(t, Stats{
+    State:               Open,
+    StateSince:          time.Unix(1003, 0),
+    NextTransition:      time.Unix(1006, 0),
+    ConsecutiveFailures: 2,
+    Successes:           2,
+    Failures:            2,
+    Rejections:          2,
+    SlowCalls:           1,
+  }, cb.Stats())
+
+  clk.Advance(3 * time.Second)
+  cb.Do(func() error { return nil })
+  cb.Do(func() error { return nil })
+  assert.Equal(t, Stats{
+    State:                HalfOpen,
+    StateSince:           time.Unix(1006, 0),
+    ConsecutiveSuccesses: 1,
+    Successes:            3,
+    Failures:             2,
+    Rejections:           3,
+    SlowCalls:            1,
+  }, cb.Stats(), "the second call should be rejected by the half-open strategy")
+
+  clk.Advance(time.Second)
+  cb.Do(func() error { return nil })
+  stats := cb.Stats()
+  assert.Equal(t, Closed, stats.State)
+  assert.Equal(t, uint32(2), stats.ConsecutiveSuccesses)
+  assert.Equal(t, uint64(4), stats.Successes)
+}
+
+func TestStatsShouldReturnTheWindowFailureRate(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailureRateWindow(10, 10, 50))
+
+  cb.Do(func() error { return nil })
+  cb.Do(func() error { return errors.New("operation error") })
+  cb.Do(func() error { return nil })
+  cb.Do(func() error { return nil })
+
+  assert.Equal(t, WindowStats{Calls: 4, Failures: 1, FailureRate: 25}, cb.Stats().Window)
+}
+
+var errIgnored = errors.New("ignored error")
@@ -4,8 +4,22 @@ import "errors"
 
 var ErrHalfOpen = errors.New("circuit breaker is half open")
 
+// ErrIgnored is returned by an operation whose outcome is neither a success nor a failure,
+// for example when the caller gave up on it. The circuit breaker also ignores the errors
+// matching it with errors.Is. The strategy must let another request through
+// without counting it.
+var ErrIgnored = errors.New("circuit breaker call ignored")
+
 type Strategy interface {
   Reset(int64)
   Process(func() error ) (err error, toOpen bool, toClose bool)
 }
 
+// Recorder is implemented by the strategies able to let a call through outside of Process,
+// like a stream whose outcome is only known once it ends. Acquire lets the call through the
+// way Process does, or returns ErrHalfOpen, and Record counts its outcome.
+type Recorder interface {
+  Acquire() error
+  Record(err error) (toOpen bool, toClose bool)
+}
+
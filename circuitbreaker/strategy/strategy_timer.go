@@ -4,8 +4,12 @@ import (
   "sync"
   "sync/atomic"
   "time"
+
+  "github.com/ocampeau/gutils/circuitbreaker/clock"
 )
 
+type TimerOptions func(s *halfOpenTimer)
+
 type halfOpenTimer struct {
   inFlight           int32
   expireAt           int64
@@ -13,15 +17,28 @@ type halfOpenTimer struct {
   consecutiveSuccess uint32
   successThreshold   uint32
   l *sync.Mutex
+  clock clock.Clock
 }
 
-func NewTimerStrategy(expireInterval time.Duration, threshold uint32) *halfOpenTimer {
-  return &halfOpenTimer{
+func NewTimerStrategy(expireInterval time.Duration, threshold uint32, opts ...TimerOptions) *halfOpenTimer {
+  s := &halfOpenTimer{
     inFlight:           0,
     expireAt:           0,
     successThreshold: threshold,
     l: &sync.Mutex{},
     expireInterval: expireInterval,
+    clock: clock.New(),
+  }
+
+  for _, apply := range opts {
+    apply(s)
+  }
+  return s
+}
+
+func WithClock(c clock.Clock) TimerOptions {
+  return func(s *halfOpenTimer) {
+    s.clock = c
   }
 }
 
@@ -34,40 +51,82 @@ func (s *halfOpenTimer) Reset(expire int64) {
 func (s *halfOpenTimer) Process(op func() error) (err error, toOpen bool, toClose bool) {
   s.l.Lock()
   defer s.l.Unlock()
-  now := time.Now().UnixMicro()
-  if s.expireAt > now{
-    return s.stayHalfOpen(ErrHalfOpen)
+  if err := s.acquire(); err != nil {
+    return s.stayHalfOpen(err)
+  }
+
+  // do the operation, making sure the in-flight slot is released
+  // if the operation panics, otherwise no other request would ever be allowed
+  completed := false
+  defer func() {
+    if !completed {
+      atomic.StoreInt32(&s.inFlight, 0)
+    }
+  }()
+  err = op()
+  completed = true
+
+  toOpen, toClose = s.record(err)
+  switch {
+  case toOpen:
+    return s.openCircuit(err)
+  case toClose:
+    return s.closeCircuit()
+  }
+  return s.stayHalfOpen(err)
+}
+
+// Acquire takes the in-flight slot for a call whose outcome is given to Record later
+func (s *halfOpenTimer) Acquire() error {
+  s.l.Lock()
+  defer s.l.Unlock()
+  return s.acquire()
+}
+
+// Record releases the in-flight slot taken by Acquire, and counts the outcome of the call
+func (s *halfOpenTimer) Record(err error) (toOpen bool, toClose bool) {
+  s.l.Lock()
+  defer s.l.Unlock()
+  return s.record(err)
+}
+
+func (s *halfOpenTimer) acquire() error {
+  now := s.clock.Now().UnixMicro()
+  if s.expireAt > now {
+    return ErrHalfOpen
   }
 
   // allow a single request at a time
   // if a request is already in flight, do nothing
   if !atomic.CompareAndSwapInt32(&s.inFlight, 0, 1) {
-    return s.stayHalfOpen(ErrHalfOpen)
+    return ErrHalfOpen
   }
+  return nil
+}
 
-  // do the operation
-  err = op()
+func (s *halfOpenTimer) record(err error) (toOpen bool, toClose bool) {
+  // the outcome is not counted, the next request is allowed right away
+  if err == ErrIgnored {
+    atomic.StoreInt32(&s.inFlight, 0)
+    return false, false
+  }
 
   // if the operation returns an error, open the circuit again
   // and reset the state to its initial value
   if err != nil {
-    return s.openCircuit(err)
+    return true, false
   }
 
   // reset the timer
-  s.expireAt = time.Now().Add(s.expireInterval).UnixMicro()
+  s.expireAt = s.clock.Now().Add(s.expireInterval).UnixMicro()
 
   // set the inFlight flag to false in order to allow another request
-  s.inFlight = 0
+  atomic.StoreInt32(&s.inFlight, 0)
 
   // if the operation is a success, only close the circuit once we reached
   // the success threshold
   cs := atomic.AddUint32(&s.consecutiveSuccess, 1)
-  if cs == s.successThreshold {
-    return s.closeCircuit()
-  } else {
-    return s.stayHalfOpen(err)
-  }
+  return false, cs == s.successThreshold
 }
 
 func (s *halfOpenTimer) openCircuit(err error) (error, bool, bool) {
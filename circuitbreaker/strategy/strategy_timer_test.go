@@ -1,25 +1,28 @@
 package strategy
 
 import (
-  "context"
+  "errors"
+  "github.com/ocampeau/gutils/circuitbreaker/clock"
   "github.com/stretchr/testify/assert"
   "runtime"
   "sync"
+  "sync/atomic"
   "testing"
   "time"
 )
 
 func TestHalfOpenTimerStrategyProcessNotExpired(t *testing.T) {
+  now := time.Unix(1000, 0)
   testCases := []struct {
     description        string
     expireAt         int64
-    testDuration time.Duration
+    numCalls int
     shouldErr bool
   }{
     {
       description: "when delay interval is not expired, it shouldn't open nor close the circuit",
-      expireAt: time.Now().Add(24 * time.Hour).UnixMicro(),
-      testDuration: 1 * time.Second,
+      expireAt: now.Add(24 * time.Hour).UnixMicro(),
+      numCalls: 1000,
       shouldErr: true,
     },
   }
@@ -28,24 +31,17 @@ func TestHalfOpenTimerStrategyProcessNotExpired(t *testing.T) {
       s := &halfOpenTimer{
         expireAt:           tc.expireAt,
         l: &sync.Mutex{},
+        clock: clock.NewFake(now),
       }
 
       op := func() error {return nil}
-      ctx, cancel := context.WithCancel(context.Background())
-      go func(){
-        <- time.After(tc.testDuration)
-        cancel()
-      }()
 
       wg := sync.WaitGroup{}
       for i := 0; i < runtime.NumCPU(); i++{
         wg.Add(1)
         go func(){
           defer wg.Done()
-          for{
-            if ctx.Err() != nil{
-              break
-            }
+          for j := 0; j < tc.numCalls; j++{
             err, doOpen, doClose := s.Process(op)
             assert.Equal(t, tc.shouldErr, err != nil)
             assert.False(t, doOpen)
@@ -59,78 +55,130 @@ func TestHalfOpenTimerStrategyProcessNotExpired(t *testing.T) {
 }
 
 func TestHalfOpenTimerStrategyProcessInFlight(t *testing.T) {
+  now := time.Unix(1000, 0)
   testCases := []struct {
     description        string
     expireAt         int64
-    testDuration time.Duration
+    numIntervals int
     delayDuration time.Duration
     successThreshold uint32
-    shouldErr bool
   }{
     {
       description: "when delay interval is expired, allow only one in-flight request per interval",
-      expireAt: time.Now().UnixMicro(),
-      testDuration: 1 * time.Second,
+      expireAt: now.UnixMicro(),
+      numIntervals: 200,
       delayDuration: 5 * time.Millisecond,
       successThreshold: 99999,
-      shouldErr: true,
     },
     {
       description: "when delay interval is expired, allow only one in-flight request per interval",
-      expireAt: time.Now().UnixMicro(),
-      testDuration: 500 * time.Millisecond,
+      expireAt: now.UnixMicro(),
+      numIntervals: 70,
       delayDuration: 7 * time.Millisecond,
       successThreshold: 99999,
-      shouldErr: true,
     },
   }
   for _, tc := range testCases {
     t.Run(tc.description, func(t *testing.T) {
+      c := clock.NewFake(now)
       s := &halfOpenTimer{
         expireAt:           tc.expireAt,
         expireInterval:     tc.delayDuration,
         successThreshold:   tc.successThreshold,
         l: &sync.Mutex{},
+        clock: c,
       }
 
-      l := sync.Mutex{}
       var numInFlightRequest uint32 = 0
       op := func() error {
-        l.Lock()
-        defer l.Unlock()
-        numInFlightRequest += 1
+        atomic.AddUint32(&numInFlightRequest, 1)
         return nil
       }
 
-      ctx, cancel := context.WithCancel(context.Background())
-      go func(){
-        <- time.After(tc.testDuration)
-        cancel()
-      }()
-
-      start := time.Now()
-      wg := sync.WaitGroup{}
-      for i := 0; i < runtime.NumCPU(); i++{
-        wg.Add(1)
-        go func(){
-          defer wg.Done()
-          for{
-            s.Process(op)
-            if ctx.Err() != nil{
-              break
+      for i := 0; i < tc.numIntervals; i++{
+        wg := sync.WaitGroup{}
+        for j := 0; j < runtime.NumCPU(); j++{
+          wg.Add(1)
+          go func(){
+            defer wg.Done()
+            for k := 0; k < 10; k++{
+              s.Process(op)
             }
-          }
-        }()
+          }()
+        }
+        wg.Wait()
+
+        // half of the interval is not enough to allow another request
+        c.Advance(tc.delayDuration / 2)
+        s.Process(op)
+        c.Advance(tc.delayDuration - tc.delayDuration / 2)
       }
 
+      assert.Equal(t, uint32(tc.numIntervals), numInFlightRequest)
+    })
 
-      wg.Wait()
-      numIntervals := time.Since(start).Microseconds() / tc.delayDuration.Microseconds()
+  }
+}
 
-      // 1 for the immediate start + 1 in case the goroutine finished before the time calculation
-      const errorMargin = 2
-      assert.InDelta(t, numIntervals, numInFlightRequest, errorMargin)
-    })
+func TestHalfOpenTimerStrategyShouldReleaseInFlightOnPanic(t *testing.T) {
+  s := NewTimerStrategy(0, 1)
+
+  assert.Panics(t, func() {
+    s.Process(func() error { panic("boom") })
+  })
+  assert.Equal(t, int32(0), s.inFlight)
+
+  called := false
+  err, _, doClose := s.Process(func() error {
+    called = true
+    return nil
+  })
+  assert.Nil(t, err)
+  assert.True(t, called)
+  assert.True(t, doClose)
+}
+
+func TestHalfOpenTimerStrategyShouldNotCountIgnoredCalls(t *testing.T) {
+  s := NewTimerStrategy(time.Hour, 1, WithClock(clock.NewFake(time.Unix(1000, 0))))
 
+  for i := 0; i < 3; i++ {
+    err, doOpen, doClose := s.Process(func() error { return ErrIgnored })
+    assert.Equal(t, ErrIgnored, err)
+    assert.False(t, doOpen)
+    assert.False(t, doClose)
   }
+  assert.Equal(t, int32(0), s.inFlight)
+  assert.Equal(t, uint32(0), s.consecutiveSuccess)
+
+  // the interval is not reset by an ignored call, so the next request is allowed
+  err, _, doClose := s.Process(func() error { return nil })
+  assert.Nil(t, err)
+  assert.True(t, doClose)
+}
+
+func TestHalfOpenTimerStrategyAcquireShouldHoldTheSlotUntilRecord(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  s := NewTimerStrategy(time.Second, 2, WithClock(clk))
+
+  assert.Nil(t, s.Acquire())
+  assert.Equal(t, ErrHalfOpen, s.Acquire(), "a single call should hold the slot")
+  err, _, _ := s.Process(func() error { return nil })
+  assert.Equal(t, ErrHalfOpen, err)
+
+  doOpen, doClose := s.Record(nil)
+  assert.False(t, doOpen)
+  assert.False(t, doClose)
+  assert.Equal(t, ErrHalfOpen, s.Acquire(), "the next call should wait for the interval")
+
+  clk.Advance(time.Second)
+  assert.Nil(t, s.Acquire())
+  doOpen, doClose = s.Record(nil)
+  assert.False(t, doOpen)
+  assert.True(t, doClose)
+
+  s.Reset(0)
+  assert.Nil(t, s.Acquire())
+  doOpen, doClose = s.Record(errors.New("boom"))
+  assert.True(t, doOpen)
+  assert.False(t, doClose)
 }
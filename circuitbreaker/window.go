@@ -0,0 +1,222 @@
+package circuitbreaker
+
+import (
+  "runtime"
+  "sync/atomic"
+  "time"
+
+  "github.com/ocampeau/gutils/circuitbreaker/clock"
+)
+
+// failureWindow is used in the closed state in place of the consecutive failures
+// counter. It keeps track of the outcome of the recent calls, the circuit breaker
+// then decides if it should open based on the counts returned by the window.
+type failureWindow interface {
+  record(failure, slow bool) windowCounts
+  counts() windowCounts
+  reset()
+}
+
+type windowCounts struct {
+  calls     uint64
+  failures  uint64
+  slowCalls uint64
+}
+
+// the outcome of a call is stored as a bit set in the ring buffer slots,
+// a slot equal to 0 has never been written
+const (
+  slotRecorded uint32 = 1 << iota
+  slotFailure
+  slotSlow
+)
+
+// countWindow is a lock-free ring buffer keeping the outcome of the last `size` calls.
+// The counters are updated with atomic operations only, which means that under heavy
+// concurrency the counts are an approximation, but it never allocates.
+type countWindow struct {
+  cursor    uint64
+  failures  int64
+  slowCalls int64
+  size      uint64
+  slots     []uint32
+}
+
+func newCountWindow(size uint32) *countWindow {
+  if size == 0 {
+    size = 1
+  }
+  return &countWindow{
+    size:  uint64(size),
+    slots: make([]uint32, size),
+  }
+}
+
+func (w *countWindow) record(failure, slow bool) windowCounts {
+  outcome := slotRecorded
+  if failure {
+    outcome |= slotFailure
+  }
+  if slow {
+    outcome |= slotSlow
+  }
+
+  n := atomic.AddUint64(&w.cursor, 1)
+  previous := atomic.SwapUint32(&w.slots[(n-1)%w.size], outcome)
+
+  calls := n
+  if calls > w.size {
+    calls = w.size
+  }
+  return windowCounts{
+    calls:     calls,
+    failures:  updateSlotCounter(&w.failures, previous, outcome, slotFailure),
+    slowCalls: updateSlotCounter(&w.slowCalls, previous, outcome, slotSlow),
+  }
+}
+
+// updateSlotCounter only updates the counter when the flag of the slot changed
+func updateSlotCounter(counter *int64, previous, outcome, flag uint32) uint64 {
+  var n int64
+  switch {
+  case previous&flag == 0 && outcome&flag != 0:
+    n = atomic.AddInt64(counter, 1)
+  case previous&flag != 0 && outcome&flag == 0:
+    n = atomic.AddInt64(counter, -1)
+  default:
+    n = atomic.LoadInt64(counter)
+  }
+  if n < 0 {
+    return 0
+  }
+  return uint64(n)
+}
+
+func (w *countWindow) counts() windowCounts {
+  calls := atomic.LoadUint64(&w.cursor)
+  if calls > w.size {
+    calls = w.size
+  }
+  wc := windowCounts{calls: calls}
+  if n := atomic.LoadInt64(&w.failures); n > 0 {
+    wc.failures = uint64(n)
+  }
+  if n := atomic.LoadInt64(&w.slowCalls); n > 0 {
+    wc.slowCalls = uint64(n)
+  }
+  return wc
+}
+
+func (w *countWindow) reset() {
+  atomic.StoreUint64(&w.cursor, 0)
+  for i := range w.slots {
+    atomic.StoreUint32(&w.slots[i], 0)
+  }
+  atomic.StoreInt64(&w.failures, 0)
+  atomic.StoreInt64(&w.slowCalls, 0)
+}
+
+// timeBucket aggregates the calls made during one bucket interval. The number of calls
+// and failures are packed in a single word so they can be updated with a single atomic
+// operation: the high 32 bits hold the number of calls and the low 32 bits the number
+// of failures.
+type timeBucket struct {
+  epoch     int64
+  counts    uint64
+  slowCalls uint64
+}
+
+const (
+  bucketCall     uint64 = 1 << 32
+  bucketFailures uint64 = 1<<32 - 1
+  // the epoch of a bucket while its counters are reset
+  bucketRolling int64 = -1
+)
+
+// timeWindow counts the calls made during the last `len(buckets) * bucketDuration`.
+// Buckets are rolled lazily when a call falls into a bucket that belongs to an
+// expired interval, so there is no background goroutine involved. The calls falling
+// into a bucket being rolled wait for its counters to be reset, so no call is lost.
+type timeWindow struct {
+  bucketDuration int64
+  buckets        []timeBucket
+  clock          clock.Clock
+}
+
+func newTimeWindow(window time.Duration, numBuckets uint32, clk clock.Clock) *timeWindow {
+  if numBuckets == 0 {
+    numBuckets = 1
+  }
+  bucketDuration := int64(window) / int64(numBuckets)
+  if bucketDuration <= 0 {
+    bucketDuration = 1
+  }
+  return &timeWindow{
+    bucketDuration: bucketDuration,
+    buckets:        make([]timeBucket, numBuckets),
+    clock:          clk,
+  }
+}
+
+func (w *timeWindow) record(failure, slow bool) windowCounts {
+  epoch := w.clock.Now().UnixNano() / w.bucketDuration
+
+  b := &w.buckets[epoch%int64(len(w.buckets))]
+  w.roll(b, epoch)
+
+  delta := bucketCall
+  if failure {
+    delta++
+  }
+  atomic.AddUint64(&b.counts, delta)
+  if slow {
+    atomic.AddUint64(&b.slowCalls, 1)
+  }
+
+  return w.sum(epoch)
+}
+
+// roll resets the counters of the bucket if they belong to an expired interval
+func (w *timeWindow) roll(b *timeBucket, epoch int64) {
+  for {
+    e := atomic.LoadInt64(&b.epoch)
+    switch {
+    case e >= epoch:
+      return
+    case e == bucketRolling:
+      // another goroutine is resetting the counters, adding to them now would be lost
+      runtime.Gosched()
+    case atomic.CompareAndSwapInt64(&b.epoch, e, bucketRolling):
+      // only the goroutine that rolls the bucket resets its counters, the
+      // epoch is published once they are reset
+      atomic.StoreUint64(&b.counts, 0)
+      atomic.StoreUint64(&b.slowCalls, 0)
+      atomic.StoreInt64(&b.epoch, epoch)
+      return
+    }
+  }
+}
+
+func (w *timeWindow) counts() windowCounts {
+  return w.sum(w.clock.Now().UnixNano() / w.bucketDuration)
+}
+
+func (w *timeWindow) sum(epoch int64) (wc windowCounts) {
+  for i := range w.buckets {
+    if epoch-atomic.LoadInt64(&w.buckets[i].epoch) >= int64(len(w.buckets)) {
+      continue
+    }
+    counts := atomic.LoadUint64(&w.buckets[i].counts)
+    wc.calls += counts >> 32
+    wc.failures += counts & bucketFailures
+    wc.slowCalls += atomic.LoadUint64(&w.buckets[i].slowCalls)
+  }
+  return
+}
+
+func (w *timeWindow) reset() {
+  for i := range w.buckets {
+    atomic.StoreUint64(&w.buckets[i].counts, 0)
+    atomic.StoreUint64(&w.buckets[i].slowCalls, 0)
+  }
+}
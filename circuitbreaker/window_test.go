@@ -0,0 +1,175 @@
+package circuitbreaker
+
+import (
+  "errors"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/ocampeau/gutils/circuitbreaker/clock"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestCountWindowShouldTripOnlyAfterMinCalls(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailureRateWindow(10, 5, 50))
+
+  for i := 0; i < 4; i++ {
+    assert.False(t, cb.shouldTrip(cb.window.record(true, false)), "should not trip before min calls at call %d", i+1)
+  }
+  assert.True(t, cb.shouldTrip(cb.window.record(true, false)))
+}
+
+func TestCountWindowShouldEvictOldestOutcome(t *testing.T) {
+  w := newCountWindow(4)
+
+  // [F S S S] -> 1 failure
+  w.record(true, false)
+  w.record(false, false)
+  w.record(false, false)
+  assert.Equal(t, windowCounts{calls: 4, failures: 1}, w.record(false, false))
+
+  // [F S S S] -> [S S S F], the first failure was evicted
+  assert.Equal(t, windowCounts{calls: 4, failures: 1}, w.record(true, false))
+
+  // [S S F F]
+  w.record(false, false)
+  assert.Equal(t, windowCounts{calls: 4, failures: 2, slowCalls: 1}, w.record(true, true))
+  assert.Equal(t, windowCounts{calls: 4, failures: 2, slowCalls: 1}, w.counts())
+}
+
+func TestCountWindowReset(t *testing.T) {
+  w := newCountWindow(4)
+  w.record(true, true)
+  w.reset()
+
+  assert.Equal(t, windowCounts{}, w.counts())
+  assert.Equal(t, windowCounts{calls: 1, failures: 1}, w.record(true, false))
+}
+
+func TestCountWindowConcurrent(t *testing.T) {
+  const size, numGoroutine, numCalls = 100, 8, 1000
+  w := newCountWindow(size)
+
+  wg := sync.WaitGroup{}
+  for i := 0; i < numGoroutine; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      for j := 0; j < numCalls; j++ {
+        w.record(i%2 == 0, j%3 == 0)
+      }
+    }(i)
+  }
+  wg.Wait()
+
+  var failures, slowCalls uint64
+  for _, s := range w.slots {
+    if s&slotFailure != 0 {
+      failures++
+    }
+    if s&slotSlow != 0 {
+      slowCalls++
+    }
+  }
+  assert.Equal(t, windowCounts{calls: size, failures: failures, slowCalls: slowCalls}, w.counts())
+}
+
+func TestCircuitShouldOpenWhenFailureRateIsReached(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailureRateWindow(10, 10, 50))
+
+  var numOpen int
+  cb.RegisterOnOpenHooks(func() {
+    numOpen++
+  })
+
+  // a dependency failing 60% of the time never reaches the consecutive failures threshold
+  errOp := errors.New("operation error")
+  for i := 0; i < 10 && cb.state == Closed; i++ {
+    cb.Do(func() error {
+      if i%5 < 3 {
+        return errOp
+      }
+      return nil
+    })
+  }
+
+  assert.Equal(t, Open, cb.state)
+  assert.Equal(t, 1, numOpen)
+}
+
+func TestTimeWindowShouldOnlyCountCallsInsideTheWindow(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  w := newTimeWindow(10*time.Second, 10, clk)
+
+  // 3 failures in the first second
+  w.record(true, false)
+  w.record(true, true)
+  w.record(true, false)
+
+  // 10 seconds later, the failures are out of the window
+  clk.Advance(10 * time.Second)
+  assert.Equal(t, windowCounts{calls: 1}, w.record(false, false))
+  assert.Equal(t, windowCounts{calls: 2, failures: 1}, w.record(true, false))
+}
+
+func TestTimeWindowShouldAggregateAllBuckets(t *testing.T) {
+  clk := clock.NewFake(time.Unix(1000, 0))
+  cb := NewCircuitBreaker("test", WithClock(clk), WithFailureRateTimeWindow(10*time.Second, 10, 10, 60))
+  w := cb.window
+
+  // 1 call per second, failing 6 times out of 10
+  var wc windowCounts
+  for i := 0; i < 10; i++ {
+    wc = w.record(i%5 < 3, false)
+    clk.Advance(time.Second)
+  }
+  assert.Equal(t, windowCounts{calls: 10, failures: 6}, wc)
+  assert.True(t, cb.shouldTrip(wc))
+
+  w.reset()
+  assert.False(t, cb.shouldTrip(w.record(true, false)), "min calls should be counted from the reset")
+}
+
+func TestCircuitShouldOpenWhenTimeWindowFailureRateIsReached(t *testing.T) {
+  cb := NewCircuitBreaker("test", WithFailureRateTimeWindow(10*time.Second, 10, 10, 50))
+
+  errOp := errors.New("operation error")
+  for i := 0; i < 10 && cb.state == Closed; i++ {
+    cb.Do(func() error {
+      if i%2 == 0 {
+        return errOp
+      }
+      return nil
+    })
+  }
+
+  assert.Equal(t, Open, cb.state)
+}
+
+func TestTimeWindowShouldNotLoseCallsWhenRollingConcurrent(t *testing.T) {
+  const numGoroutine, numCalls = 8, 1000
+  clk := clock.NewFake(time.Unix(1000, 0))
+  w := newTimeWindow(4*time.Second, 4, clk)
+
+  for round := 0; round < 20; round++ {
+    // every round falls into a bucket used by a previous interval, which has to be rolled
+    clk.Advance(time.Second)
+
+    wg := sync.WaitGroup{}
+    for i := 0; i < numGoroutine; i++ {
+      wg.Add(1)
+      go func() {
+        defer wg.Done()
+        for j := 0; j < numCalls; j++ {
+          w.record(true, true)
+        }
+      }()
+    }
+    wg.Wait()
+
+    b := w.buckets[(clk.Now().Unix())%4]
+    assert.Equal(t, uint64(numGoroutine*numCalls), b.counts>>32, "calls lost in round %d", round)
+    assert.Equal(t, uint64(numGoroutine*numCalls), b.counts&bucketFailures)
+    assert.Equal(t, uint64(numGoroutine*numCalls), b.slowCalls)
+  }
+}